@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// archiveDir is the directory in the destination that keeps the event
+// logs of archive repositories.
+const archiveDir = ".archive"
+
+// Archive events
+const (
+	archiveAdded   = "added"
+	archiveRemoved = "removed"
+)
+
+// archiveEvent records that a package was added to or removed from the
+// repodata of a repository.
+type archiveEvent struct {
+	Time       time.Time `json:"time"`
+	Repository string    `json:"repository"`
+	Event      string    `json:"event"`
+	Pkgver     string    `json:"pkgver"`
+	Filename   string    `json:"filename"`
+	SHA256     string    `json:"sha256,omitempty"`
+}
+
+// pkgname returns the package name of the pkgver of the event.
+func (ev *archiveEvent) pkgname() string {
+	if i := strings.LastIndexByte(ev.Pkgver, '-'); i > 0 {
+		return ev.Pkgver[:i]
+	}
+	return ev.Pkgver
+}
+
+// archiveLog is the append-only event log of an archive repository, a
+// JSON document per line.
+type archiveLog struct {
+	mu         sync.Mutex
+	path       string
+	repository string
+}
+
+// openArchive returns the event log of conf if it is an archive
+// repository. If the log does not exist yet, e.g. when an existing mirror
+// is turned into an archive, all packages of idx are recorded as added.
+func openArchive(conf *config.RepositoryConfig, idx index) (*archiveLog, error) {
+	if conf.Mode != config.ModeArchive {
+		return nil, nil
+	}
+	a := &archiveLog{
+		path:       filepath.Join(conf.Destination, archiveDir, fmt.Sprintf("%s-repodata.jsonl", conf.Architecture)),
+		repository: conf.Name,
+	}
+	if _, err := os.Stat(a.path); err == nil {
+		return a, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	diff := index(nil).Diff(idx)
+	if err := a.record(time.Now(), &diff); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// record appends the changes in diff to the log.
+func (a *archiveLog) record(now time.Time, diff *indexDiff) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, changes := range []struct {
+		event string
+		pkgs  []*pkg
+	}{
+		{archiveRemoved, diff.Deleted},
+		{archiveAdded, diff.Added},
+	} {
+		for _, pkg := range changes.pkgs {
+			err := enc.Encode(&archiveEvent{
+				Time:       now,
+				Repository: a.repository,
+				Event:      changes.event,
+				Pkgver:     pkg.Pkgver,
+				Filename:   pkg.Filename(),
+				SHA256:     hex.EncodeToString(pkg.SHA256),
+			})
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archiveQuery selects events from the log, empty fields match all
+// events.
+type archiveQuery struct {
+	Pkgname string
+	Pkgver  string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (q *archiveQuery) match(ev *archiveEvent) bool {
+	return (q.Pkgname == "" || ev.pkgname() == q.Pkgname) &&
+		(q.Pkgver == "" || ev.Pkgver == q.Pkgver) &&
+		(q.Since.IsZero() || !ev.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || ev.Time.Before(q.Until))
+}
+
+// query returns the events of the log that match q.
+func (a *archiveLog) query(q *archiveQuery) ([]*archiveEvent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var events []*archiveEvent
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var ev archiveEvent
+		if err := dec.Decode(&ev); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.path, err)
+		}
+		if q.match(&ev) {
+			events = append(events, &ev)
+		}
+	}
+	return events, nil
+}
+
+// archiveHandler queries the event logs of the archive repositories. The
+// query parameters "repository", "pkgname", "pkgver", "since" and "until"
+// select the events, the times are RFC 3339.
+type archiveHandler struct {
+	repos []*Repository
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := req.URL.Query()
+	q := &archiveQuery{
+		Pkgname: params.Get("pkgname"),
+		Pkgver:  params.Get("pkgver"),
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		value := params.Get(t.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		if *t.dst, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", t.name, err), http.StatusBadRequest)
+			return
+		}
+	}
+	name := params.Get("repository")
+	events := []*archiveEvent{}
+	for _, r := range h.repos {
+		if r.archive == nil || (name != "" && r.Config.Name != name) {
+			continue
+		}
+		found, err := r.archive.query(q)
+		if err != nil {
+			slog.Error("querying archive failed", "repository", r.Config.Name, "error", err)
+			http.Error(w, "querying archive failed", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, found...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
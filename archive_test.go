@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+func TestArchive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+
+	repo := testFileRepository(t, ctx, upstream)
+	repo.Config.Mode = config.ModeArchive
+	var err error
+	if repo.archive, err = openArchive(repo.Config, repo.Repodata.index); err != nil {
+		t.Fatal(err)
+	}
+	syncRepository(t, ctx, repo)
+	start := time.Now()
+	foo2 := testPkg(t, upstream, "foo-1.1_1", "foo2")
+	writeRepodata(t, repodata, foo2)
+	syncRepository(t, ctx, repo)
+	// the archive keeps every package
+	assertStored(t, repo, foo.Filename(), bar.Filename(), foo2.Filename())
+
+	query := func(params string) []*archiveEvent {
+		rec := httptest.NewRecorder()
+		h := &archiveHandler{repos: []*Repository{repo}}
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/archive?"+params, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", params, rec.Code)
+		}
+		var events []*archiveEvent
+		if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	if events := query(""); len(events) != 5 {
+		t.Errorf("expected 5 events, got %d", len(events))
+	}
+	events := query("pkgname=foo")
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events of foo, got %d", len(events))
+	}
+	if ev := events[0]; ev.Event != archiveAdded || ev.Pkgver != foo.Pkgver {
+		t.Errorf("expected %s to be added first, got %+v", foo.Pkgver, ev)
+	}
+	events = query("pkgver=bar-1.0_1")
+	if len(events) != 2 || events[1].Event != archiveRemoved || events[1].Repository != "test/x86_64" {
+		t.Errorf("expected bar to be added and removed, got %+v", events)
+	}
+	events = query("since=" + start.Format(time.RFC3339Nano) + "&pkgname=foo")
+	if len(events) != 2 {
+		t.Errorf("expected 2 events since the update, got %d", len(events))
+	}
+	if events := query("repository=other"); len(events) != 0 {
+		t.Errorf("expected no events of other repositories, got %d", len(events))
+	}
+
+	// reopening the log does not record the index again
+	if repo.archive, err = openArchive(repo.Config, repo.Repodata.index); err != nil {
+		t.Fatal(err)
+	}
+	if events := query(""); len(events) != 5 {
+		t.Errorf("expected 5 events after reopening, got %d", len(events))
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// changesDir is the directory in the destination that keeps the recent
+// changes of the repositories.
+const changesDir = ".changes"
+
+// changesHistory is the number of changes kept per repository.
+const changesHistory = 100
+
+// pkgChange is a package that was added, updated, rebuilt or removed. Old
+// and New are the versions before and after the change.
+type pkgChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+func (c pkgChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s %s added", c.Name, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%s %s removed", c.Name, c.Old)
+	case c.Old == c.New:
+		return fmt.Sprintf("%s %s rebuilt", c.Name, c.New)
+	default:
+		return fmt.Sprintf("%s %s -> %s", c.Name, c.Old, c.New)
+	}
+}
+
+// splitPkgver splits pkgver into the package name and version.
+func splitPkgver(pkgver string) (name, version string) {
+	if i := strings.LastIndexByte(pkgver, '-'); i > 0 {
+		return pkgver[:i], pkgver[i+1:]
+	}
+	return pkgver, ""
+}
+
+// change is a non-empty diff of an index.
+type change struct {
+	Time       time.Time   `json:"time"`
+	Index      string      `json:"index"`
+	Added      []pkgChange `json:"added,omitempty"`
+	Updated    []pkgChange `json:"updated,omitempty"`
+	Downgraded []pkgChange `json:"downgraded,omitempty"`
+	Rebuilt    []pkgChange `json:"rebuilt,omitempty"`
+	Removed    []pkgChange `json:"removed,omitempty"`
+}
+
+// newChange returns the change of the index file in diff. It returns nil
+// if diff is empty.
+func newChange(now time.Time, file string, diff *indexDiff) *change {
+	if diff == nil || len(diff.Added) == 0 && len(diff.Deleted) == 0 && len(diff.Rebuilt) == 0 {
+		return nil
+	}
+	c := &change{Time: now, Index: file}
+	updated := make(map[string]struct{})
+	for _, u := range []struct {
+		dst  *[]pkgChange
+		pkgs []pkgUpdate
+	}{
+		{&c.Updated, diff.Upgraded},
+		{&c.Downgraded, diff.Downgraded},
+		{&c.Rebuilt, diff.Rebuilt},
+	} {
+		for _, pkg := range u.pkgs {
+			name, old := splitPkgver(pkg.Old.Pkgver)
+			_, version := splitPkgver(pkg.New.Pkgver)
+			*u.dst = append(*u.dst, pkgChange{Name: name, Old: old, New: version})
+			updated[name] = struct{}{}
+		}
+	}
+	for _, pkg := range diff.Added {
+		name, version := splitPkgver(pkg.Pkgver)
+		if _, ok := updated[name]; !ok {
+			c.Added = append(c.Added, pkgChange{Name: name, New: version})
+		}
+	}
+	for _, pkg := range diff.Deleted {
+		name, version := splitPkgver(pkg.Pkgver)
+		if _, ok := updated[name]; !ok {
+			c.Removed = append(c.Removed, pkgChange{Name: name, Old: version})
+		}
+	}
+	for _, pkgs := range [][]pkgChange{c.Added, c.Updated, c.Downgraded, c.Rebuilt, c.Removed} {
+		sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	}
+	return c
+}
+
+// Title summarizes the change.
+func (c *change) Title(repository string) string {
+	var counts []string
+	for _, n := range []struct {
+		count int
+		what  string
+	}{
+		{len(c.Updated), "updated"},
+		{len(c.Downgraded), "downgraded"},
+		{len(c.Rebuilt), "rebuilt"},
+		{len(c.Added), "added"},
+		{len(c.Removed), "removed"},
+	} {
+		if n.count > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n.count, n.what))
+		}
+	}
+	return fmt.Sprintf("%s %s: %s", repository, c.Index, strings.Join(counts, ", "))
+}
+
+// Text lists the changed packages, one per line.
+func (c *change) Text() string {
+	var b strings.Builder
+	for _, pkgs := range [][]pkgChange{c.Updated, c.Downgraded, c.Rebuilt, c.Added, c.Removed} {
+		for _, pkg := range pkgs {
+			b.WriteString(pkg.String())
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// ID is a unique identifier of the change for feeds.
+func (c *change) ID(repository string) string {
+	return fmt.Sprintf("tag:void-mirror,%s:%s/%s/%d",
+		c.Time.UTC().Format("2006-01-02"), repository, c.Index, c.Time.UnixNano())
+}
+
+// changeLog keeps the recent changes of a repository, newest first.
+type changeLog struct {
+	mu      sync.Mutex
+	path    string
+	changes []*change
+}
+
+func openChangeLog(conf *config.RepositoryConfig) (*changeLog, error) {
+	l := &changeLog{
+		path: filepath.Join(conf.Destination, changesDir, fmt.Sprintf("%s.json", conf.Architecture)),
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.changes); err != nil {
+		return nil, fmt.Errorf("%s: %w", l.path, err)
+	}
+	return l, nil
+}
+
+// add adds c to the log and stores the log.
+func (l *changeLog) add(c *change) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append([]*change{c}, l.changes...)
+	if len(l.changes) > changesHistory {
+		l.changes = l.changes[:changesHistory]
+	}
+	data, err := json.Marshal(l.changes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(l.path), "."+filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (l *changeLog) list() []*change {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*change(nil), l.changes...)
+}
+
+// recordDiff records the diff of the index file in the change log and,
+// for the repodata of archive repositories, in the archive.
+func (r *Repository) recordDiff(file string, diff *indexDiff) {
+	c := newChange(time.Now(), file, diff)
+	if c == nil {
+		return
+	}
+	if err := r.changes.add(c); err != nil {
+		r.log.Error("could not record changes", "error", err)
+	}
+	if r.archive != nil && file == "repodata" {
+		if err := r.archive.record(c.Time, diff); err != nil {
+			r.log.Error("could not record changes in the archive", "error", err)
+		}
+	}
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// changesHandler serves the recent changes of a repository at
+// /changes/<repository>.json, .rss or .atom.
+type changesHandler struct {
+	repos []*Repository
+}
+
+func (h *changesHandler) find(name string) *Repository {
+	for _, r := range h.repos {
+		if r.Config.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *changesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := cleanPath(strings.TrimPrefix(req.URL.Path, "/changes"))
+	// the bare repository name serves JSON
+	ext, name := "", p
+	repo := h.find(name)
+	if repo == nil {
+		ext = path.Ext(p)
+		name = strings.TrimSuffix(p, ext)
+		repo = h.find(name)
+	}
+	if repo == nil {
+		http.NotFound(w, req)
+		return
+	}
+	changes := repo.changes.list()
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	self := fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.Path)
+	title := fmt.Sprintf("Changes of %s", name)
+	var doc any
+	switch ext {
+	case "", ".json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Repository string    `json:"repository"`
+			Changes    []*change `json:"changes"`
+		}{name, changes})
+		return
+	case ".rss":
+		feed := &rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{Title: title, Link: self, Description: title},
+		}
+		for _, c := range changes {
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       c.Title(name),
+				Description: c.Text(),
+				PubDate:     c.Time.Format(time.RFC1123Z),
+				GUID:        rssGUID{Value: c.ID(name)},
+			})
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		doc = feed
+	case ".atom":
+		feed := &atomFeed{
+			Title:   title,
+			ID:      self,
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: self, Rel: "self"},
+			Author:  atomAuthor{Name: "void-mirror"},
+		}
+		if len(changes) > 0 {
+			feed.Updated = changes[0].Time.UTC().Format(time.RFC3339)
+		}
+		for _, c := range changes {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   c.Title(name),
+				ID:      c.ID(name),
+				Updated: c.Time.UTC().Format(time.RFC3339),
+				Content: atomContent{Type: "text", Value: c.Text()},
+			})
+		}
+		w.Header().Set("Content-Type", "application/atom+xml")
+		doc = feed
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+}
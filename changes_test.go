@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	foo2 := testPkg(t, upstream, "foo-1.1_1", "foo2")
+	baz := testPkg(t, upstream, "baz-2.0_1", "baz")
+	writeRepodata(t, repodata, foo2, baz)
+	syncRepository(t, ctx, repo)
+	// unchanged repodata is not recorded
+	syncRepository(t, ctx, repo)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h := &changesHandler{repos: []*Repository{repo}}
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	// JSON is the default without an extension
+	bare := get("/changes/test/x86_64")
+	rec := get("/changes/test/x86_64.json")
+	if rec.Code != http.StatusOK || bare.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d %d", rec.Code, bare.Code)
+	}
+	if bare.Body.String() != rec.Body.String() || bare.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected JSON for the bare path, got %s", bare.Body)
+	}
+	var doc struct {
+		Repository string    `json:"repository"`
+		Changes    []*change `json:"changes"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(doc.Changes))
+	}
+	c := doc.Changes[0]
+	if len(c.Updated) != 1 || c.Updated[0] != (pkgChange{Name: "foo", Old: "1.0_1", New: "1.1_1"}) {
+		t.Errorf("expected foo to be updated, got %+v", c.Updated)
+	}
+	if len(c.Added) != 1 || c.Added[0].Name != "baz" || len(c.Removed) != 1 || c.Removed[0].Name != "bar" {
+		t.Errorf("expected baz to be added and bar removed, got %+v %+v", c.Added, c.Removed)
+	}
+	if title := c.Title("test/x86_64"); title != "test/x86_64 repodata: 1 updated, 1 added, 1 removed" {
+		t.Errorf("unexpected title %q", title)
+	}
+
+	rec = get("/changes/test/x86_64.rss")
+	var rss rssFeed
+	if err := xml.NewDecoder(rec.Body).Decode(&rss); err != nil {
+		t.Fatal(err)
+	}
+	if len(rss.Channel.Items) != 2 || !strings.Contains(rss.Channel.Items[0].Description, "foo 1.0_1 -> 1.1_1") {
+		t.Errorf("unexpected rss feed %+v", rss)
+	}
+	rec = get("/changes/test/x86_64.atom")
+	var atom atomFeed
+	if err := xml.NewDecoder(rec.Body).Decode(&atom); err != nil {
+		t.Fatal(err)
+	}
+	if len(atom.Entries) != 2 || atom.Entries[0].ID == atom.Entries[1].ID {
+		t.Errorf("unexpected atom feed %+v", atom)
+	}
+	for _, path := range []string{"/changes/test/x86_64.txt", "/changes/other.json"} {
+		if rec := get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected not found, got %d", path, rec.Code)
+		}
+	}
+
+	// the changes are kept across restarts
+	l, err := openChangeLog(repo.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := l.list(); len(changes) != 2 || changes[0].Updated[0].New != "1.1_1" {
+		t.Errorf("expected the changes to be reloaded, got %+v", changes)
+	}
+}
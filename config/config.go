@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -18,11 +19,398 @@ import (
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/json"
+
+	"github.com/void-linux/void-mirror/cron"
 )
 
 type Config struct {
 	Repositories []*RepositoryConfig `hcl:"repository,block"`
 	Jobs         int                 `hcl:"jobs,optional"`
+	Hosts        map[string]*HostConfig
+
+	TempMaxAge       time.Duration
+	SweepInterval    time.Duration
+	QuarantineMaxAge time.Duration
+
+	DefaultInterval time.Duration
+	// Jitter defaults to a tenth of the repository's interval if nil.
+	Jitter *time.Duration
+
+	Webhook *WebhookConfig
+	Hooks   []*HookConfig
+	Logging LoggingConfig
+	Tracing *TracingConfig
+	Health  HealthConfig
+
+	RsyncPath string
+}
+
+type HealthConfig struct {
+	QueueThreshold   int
+	MaxMissedUpdates int
+}
+
+const (
+	DefaultQueueThreshold   = 100
+	DefaultMaxMissedUpdates = 3
+)
+
+func decodeHealthBlock(block *hcl.Block, ctx *hcl.EvalContext) (HealthConfig, hcl.Diagnostics) {
+	var data struct {
+		QueueThreshold   *int `hcl:"queue_threshold,optional"`
+		MaxMissedUpdates *int `hcl:"max_missed_updates,optional"`
+	}
+	health := HealthConfig{
+		QueueThreshold:   DefaultQueueThreshold,
+		MaxMissedUpdates: DefaultMaxMissedUpdates,
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return health, diags
+	}
+	if data.QueueThreshold != nil {
+		health.QueueThreshold = *data.QueueThreshold
+	}
+	if data.MaxMissedUpdates != nil {
+		health.MaxMissedUpdates = *data.MaxMissedUpdates
+	}
+	return health, diags
+}
+
+// TracingConfig configures the OTLP/HTTP trace exporter.
+type TracingConfig struct {
+	// Endpoint is the host and port of the collector.
+	Endpoint    string
+	URLPath     string
+	Insecure    bool
+	Headers     map[string]string
+	ServiceName string
+	SampleRatio float64
+}
+
+func decodeTracingBlock(block *hcl.Block, ctx *hcl.EvalContext) (*TracingConfig, hcl.Diagnostics) {
+	var data struct {
+		Endpoint    string            `hcl:"endpoint,optional"`
+		URLPath     string            `hcl:"url_path,optional"`
+		Insecure    bool              `hcl:"insecure,optional"`
+		Headers     map[string]string `hcl:"headers,optional"`
+		ServiceName string            `hcl:"service_name,optional"`
+		SampleRatio *float64          `hcl:"sample_ratio,optional"`
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	tracing := &TracingConfig{
+		Endpoint:    data.Endpoint,
+		URLPath:     data.URLPath,
+		Insecure:    data.Insecure,
+		Headers:     data.Headers,
+		ServiceName: data.ServiceName,
+		SampleRatio: 1,
+	}
+	if tracing.Endpoint == "" {
+		tracing.Endpoint = "localhost:4318"
+	}
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = "void-mirror"
+	}
+	if data.SampleRatio != nil {
+		if *data.SampleRatio < 0 || *data.SampleRatio > 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid sample_ratio",
+				Detail:   fmt.Sprintf("Invalid sample_ratio: %v: must be between 0 and 1", *data.SampleRatio),
+				Subject:  &block.DefRange,
+			})
+			return nil, diags
+		}
+		tracing.SampleRatio = *data.SampleRatio
+	}
+	return tracing, diags
+}
+
+type LoggingConfig struct {
+	Format string
+	Level  string
+	// File is empty for stderr.
+	File   string
+	Source bool
+}
+
+func decodeLoggingBlock(block *hcl.Block, ctx *hcl.EvalContext) (LoggingConfig, hcl.Diagnostics) {
+	var data struct {
+		Format string `hcl:"format,optional"`
+		Level  string `hcl:"level,optional"`
+		File   string `hcl:"file,optional"`
+		Source bool   `hcl:"source,optional"`
+	}
+	logging := LoggingConfig{Format: "text", Level: "info"}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return logging, diags
+	}
+	if data.Format != "" {
+		logging.Format = data.Format
+	}
+	if data.Level != "" {
+		logging.Level = data.Level
+	}
+	logging.File, logging.Source = data.File, data.Source
+	switch logging.Format {
+	case "text", "json", "journald":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid log format",
+			Detail:   fmt.Sprintf("Invalid log format %q, expected \"text\", \"json\" or \"journald\".", logging.Format),
+			Subject:  &block.DefRange,
+		})
+	}
+	switch logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid log level",
+			Detail:   fmt.Sprintf("Invalid log level %q, expected \"debug\", \"info\", \"warn\" or \"error\".", logging.Level),
+			Subject:  &block.DefRange,
+		})
+	}
+	return logging, diags
+}
+
+// Hook events
+const (
+	EventSync       = "sync"
+	EventPackages   = "packages"
+	EventError      = "error"
+	EventQuarantine = "quarantine"
+)
+
+// HookConfig runs Command or POSTs to URL on one of Events.
+type HookConfig struct {
+	Name         string
+	Events       []string
+	Repositories []string
+	Command      []string
+	URL          *url.URL
+	Headers      map[string]string
+	Timeout      time.Duration
+	Retries      int
+	RetryDelay   time.Duration
+}
+
+const (
+	DefaultHookTimeout    = 30 * time.Second
+	DefaultHookRetryDelay = 10 * time.Second
+)
+
+func decodeHookBlock(block *hcl.Block, ctx *hcl.EvalContext) (*HookConfig, hcl.Diagnostics) {
+	var data struct {
+		Events       []string          `hcl:"events"`
+		Repositories []string          `hcl:"repositories,optional"`
+		Command      []string          `hcl:"command,optional"`
+		URL          string            `hcl:"url,optional"`
+		Headers      map[string]string `hcl:"headers,optional"`
+		Timeout      string            `hcl:"timeout,optional"`
+		Retries      int               `hcl:"retries,optional"`
+		RetryDelay   string            `hcl:"retry_delay,optional"`
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	hook := &HookConfig{
+		Name:         block.Labels[0],
+		Events:       data.Events,
+		Repositories: data.Repositories,
+		Command:      data.Command,
+		Headers:      data.Headers,
+		Timeout:      DefaultHookTimeout,
+		Retries:      data.Retries,
+		RetryDelay:   DefaultHookRetryDelay,
+	}
+	for _, event := range data.Events {
+		switch event {
+		case EventSync, EventPackages, EventError, EventQuarantine:
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid event",
+				Detail:   fmt.Sprintf("Invalid event %q in hook %q, expected one of %q, %q, %q or %q.", event, hook.Name, EventSync, EventPackages, EventError, EventQuarantine),
+				Subject:  &block.DefRange,
+			})
+			return nil, diags
+		}
+	}
+	if data.Retries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid retries",
+			Detail:   fmt.Sprintf("Invalid retries: %d: must not be negative", data.Retries),
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	if (len(data.Command) == 0) == (data.URL == "") {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid hook",
+			Detail:   fmt.Sprintf("Hook %q requires either a command or an url.", hook.Name),
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	if data.URL != "" {
+		u, err := url.Parse(data.URL)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid url",
+				Detail:   fmt.Sprintf("Invalid url: %q: %v", data.URL, err),
+			})
+			return nil, diags
+		}
+		hook.URL = u
+	}
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"timeout", data.Timeout, &hook.Timeout},
+		{"retry_delay", data.RetryDelay, &hook.RetryDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if diags = append(diags, parseDuration(d.name, d.value, nil, d.dst)...); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	return hook, diags
+}
+
+type WebhookConfig struct {
+	Path     string
+	Token    string
+	Secret   string
+	Debounce time.Duration
+	// MaxWait bounds the debounce after the first notification.
+	MaxWait time.Duration
+}
+
+const (
+	DefaultWebhookDebounce = 5 * time.Second
+	DefaultWebhookMaxWait  = time.Minute
+)
+
+func decodeWebhookBlock(block *hcl.Block, ctx *hcl.EvalContext) (*WebhookConfig, hcl.Diagnostics) {
+	var data struct {
+		Path     string `hcl:"path,optional"`
+		Token    string `hcl:"token,optional"`
+		Secret   string `hcl:"secret,optional"`
+		Debounce string `hcl:"debounce,optional"`
+		MaxWait  string `hcl:"max_wait,optional"`
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	webhook := &WebhookConfig{
+		Path:     data.Path,
+		Token:    data.Token,
+		Secret:   data.Secret,
+		Debounce: DefaultWebhookDebounce,
+		MaxWait:  DefaultWebhookMaxWait,
+	}
+	if webhook.Path == "" {
+		webhook.Path = "/trigger"
+	}
+	if webhook.Token == "" && webhook.Secret == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Unauthenticated webhook",
+			Detail:   "The webhook requires a token or secret.",
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"debounce", data.Debounce, &webhook.Debounce},
+		{"max_wait", data.MaxWait, &webhook.MaxWait},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if diags = append(diags, parseDuration(d.name, d.value, nil, d.dst)...); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if webhook.MaxWait < webhook.Debounce {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid max_wait",
+			Detail:   fmt.Sprintf("Invalid max_wait: %s: must not be shorter than the debounce %s", webhook.MaxWait, webhook.Debounce),
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	return webhook, diags
+}
+
+const (
+	DefaultPollInterval  = 5 * time.Minute
+	DefaultTempMaxAge    = 1 * time.Hour
+	DefaultSweepInterval = 10 * time.Minute
+	// DefaultQuarantineMaxAge keeps quarantined downloads for a week.
+	DefaultQuarantineMaxAge = 7 * 24 * time.Hour
+)
+
+func decodeDuration(attr *hcl.Attribute, ctx *hcl.EvalContext, dst *time.Duration) hcl.Diagnostics {
+	var value string
+	diags := gohcl.DecodeExpression(attr.Expr, ctx, &value)
+	if diags.HasErrors() {
+		return diags
+	}
+	return append(diags, parseDuration(attr.Name, value, &attr.Range, dst)...)
+}
+
+// parseDuration parses value, the duration option name, into dst.
+func parseDuration(name, value string, subject *hcl.Range, dst *time.Duration) hcl.Diagnostics {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", name),
+			Detail:   fmt.Sprintf("Invalid %s: %q: %v", name, value, err),
+			Subject:  subject,
+		}}
+	}
+	*dst = d
+	return nil
+}
+
+// decodePositiveDuration is decodeDuration for durations that must be
+// greater than zero.
+func decodePositiveDuration(attr *hcl.Attribute, ctx *hcl.EvalContext, dst *time.Duration) hcl.Diagnostics {
+	diags := decodeDuration(attr, ctx, dst)
+	if !diags.HasErrors() && *dst <= 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid %s", attr.Name),
+			Detail:   fmt.Sprintf("Invalid %s: %s: must be positive", attr.Name, *dst),
+			Subject:  &attr.Range,
+		})
+	}
+	return diags
 }
 
 type local struct {
@@ -52,30 +440,182 @@ func decodeLocalsBlock(block *hcl.Block) ([]*local, hcl.Diagnostics) {
 	return locals, diags
 }
 
+type S3Config struct {
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	Region   string
+	// read from the environment if empty
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+	PartSize  uint64
+}
+
+const DefaultS3PartSize = 16 << 20
+
+func decodeS3Block(block *hcl.Block, ctx *hcl.EvalContext) (*S3Config, hcl.Diagnostics) {
+	var data struct {
+		Endpoint  string  `hcl:"endpoint"`
+		Bucket    string  `hcl:"bucket"`
+		Prefix    string  `hcl:"prefix,optional"`
+		Region    string  `hcl:"region,optional"`
+		AccessKey string  `hcl:"access_key,optional"`
+		SecretKey string  `hcl:"secret_key,optional"`
+		Insecure  bool    `hcl:"insecure,optional"`
+		PartSize  *uint64 `hcl:"part_size,optional"`
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	s3 := &S3Config{
+		Endpoint:  data.Endpoint,
+		Bucket:    data.Bucket,
+		Prefix:    strings.Trim(data.Prefix, "/"),
+		Region:    data.Region,
+		AccessKey: data.AccessKey,
+		SecretKey: data.SecretKey,
+		Insecure:  data.Insecure,
+		PartSize:  DefaultS3PartSize,
+	}
+	if data.PartSize != nil {
+		// S3 rejects parts smaller than 5 MiB
+		if *data.PartSize < 5<<20 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid part_size",
+				Detail:   fmt.Sprintf("Invalid part_size: %d: must be at least 5 MiB", *data.PartSize),
+				Subject:  &block.DefRange,
+			})
+			return nil, diags
+		}
+		s3.PartSize = *data.PartSize
+	}
+	return s3, diags
+}
+
 type RepositoryConfig struct {
+	Name         string
 	Upstream     *url.URL
 	Destination  string
 	Architecture string
 	Interval     *time.Duration
+	Jitter       *time.Duration
+	// Schedule replaces the Interval if set.
+	Schedule *cron.Schedule
+	// Poll is false if the repository is only updated when triggered.
+	Poll     bool
+	Priority int
+	// Seed is an rsync:// URL used when SeedThreshold packages are missing.
+	Seed              *url.URL
+	SeedThreshold     int
+	S3                *S3Config
+	ObsoleteMaxAge    time.Duration
+	TrustedKeys       []string
+	IndexSignature    bool
+	RequireSignatures bool
+	Snapshots         int
+	Mode              string
+	Downgrades        string
+}
+
+// Downgrade policies
+const (
+	DowngradeAccept = "accept"
+	DowngradeWarn   = "warn"
+	DowngradeHold   = "hold"
+)
+
+// Repository modes
+const (
+	ModeMirror  = "mirror"
+	ModeArchive = "archive"
+)
+
+const DefaultSeedThreshold = 500
+
+// defaultName derives a repository name from the upstream path and
+// architecture, e.g. "current/musl/x86_64-musl".
+func defaultName(upstream *url.URL, arch string) string {
+	p := strings.Trim(path.Clean("/"+upstream.Path), "/")
+	if p == "" {
+		return arch
+	}
+	return p + "/" + arch
 }
 
 func decodeRepositoryBlock(block *hcl.Block, ctx *hcl.EvalContext) (*RepositoryConfig, hcl.Diagnostics) {
 	var data struct {
-		Upstream     string `hcl:"upstream"`
-		Destination  string `hcl:"destination"`
-		Architecture string `hcl:"architecture"`
-		Interval     string `hcl:"interval,optional"`
+		Name              string   `hcl:"name,optional"`
+		Upstream          string   `hcl:"upstream"`
+		Destination       string   `hcl:"destination"`
+		Architecture      string   `hcl:"architecture"`
+		Interval          string   `hcl:"interval,optional"`
+		Jitter            string   `hcl:"jitter,optional"`
+		Schedule          string   `hcl:"schedule,optional"`
+		Poll              *bool    `hcl:"poll,optional"`
+		Priority          *int     `hcl:"priority,optional"`
+		Seed              string   `hcl:"seed,optional"`
+		SeedThreshold     *int     `hcl:"seed_threshold,optional"`
+		ObsoleteMaxAge    string   `hcl:"obsolete_max_age,optional"`
+		TrustedKeys       []string `hcl:"trusted_keys,optional"`
+		IndexSignature    bool     `hcl:"index_signature,optional"`
+		RequireSignatures bool     `hcl:"require_signatures,optional"`
+		Snapshots         *int     `hcl:"snapshots,optional"`
+		Mode              string   `hcl:"mode,optional"`
+		Downgrades        string   `hcl:"downgrades,optional"`
+		S3                []struct {
+			Body hcl.Body `hcl:",remain"`
+		} `hcl:"s3,block"`
 	}
 	diags := gohcl.DecodeBody(block.Body, ctx, &data)
 	if diags.HasErrors() {
 		return nil, diags
 	}
 	repo := &RepositoryConfig{
-		Destination:  data.Destination,
-		Architecture: data.Architecture,
+		Name:              data.Name,
+		Destination:       data.Destination,
+		Architecture:      data.Architecture,
+		Poll:              true,
+		Priority:          1,
+		SeedThreshold:     DefaultSeedThreshold,
+		TrustedKeys:       data.TrustedKeys,
+		IndexSignature:    data.IndexSignature,
+		RequireSignatures: data.RequireSignatures,
+	}
+	if repo.IndexSignature && len(repo.TrustedKeys) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing trusted_keys",
+			Detail:   "Verifying index signatures requires trusted_keys.",
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	if data.Poll != nil {
+		repo.Poll = *data.Poll
+	}
+	if data.Priority != nil {
+		if *data.Priority < 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid priority",
+				Detail:   fmt.Sprintf("Invalid priority: %d: must be at least 1", *data.Priority),
+			})
+			return nil, diags
+		}
+		repo.Priority = *data.Priority
 	}
 	var err error
 	repo.Upstream, err = url.Parse(data.Upstream)
+	if err == nil {
+		switch repo.Upstream.Scheme {
+		case "http", "https", "file":
+		default:
+			err = fmt.Errorf("unsupported scheme %q, expected \"http\", \"https\" or \"file\"", repo.Upstream.Scheme)
+		}
+	}
 	if err != nil {
 		diags = append(diags, &hcl.Diagnostic{
 			Severity: hcl.DiagError,
@@ -85,20 +625,263 @@ func decodeRepositoryBlock(block *hcl.Block, ctx *hcl.EvalContext) (*RepositoryC
 		return nil, diags
 	}
 	if data.Interval != "" {
-		interval, err := time.ParseDuration(data.Interval)
-		if err != nil {
+		var interval time.Duration
+		if diags = append(diags, parseDuration("interval", data.Interval, nil, &interval)...); diags.HasErrors() {
+			return nil, diags
+		}
+		if interval <= 0 {
 			diags = append(diags, &hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  "Invalid interval",
-				Detail:   fmt.Sprintf("Invalid interval: %q: %v", data.Interval, err),
+				Detail:   fmt.Sprintf("Invalid interval: %s: must be positive", interval),
+				Subject:  &block.DefRange,
 			})
 			return nil, diags
 		}
 		repo.Interval = &interval
 	}
+	if data.Jitter != "" {
+		var jitter time.Duration
+		if diags = append(diags, parseDuration("jitter", data.Jitter, nil, &jitter)...); diags.HasErrors() {
+			return nil, diags
+		}
+		repo.Jitter = &jitter
+	}
+	if data.Schedule != "" {
+		repo.Schedule, err = cron.Parse(data.Schedule)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid schedule",
+				Detail:   fmt.Sprintf("Invalid schedule: %q: %v", data.Schedule, err),
+			})
+			return nil, diags
+		}
+	}
+	if data.Seed != "" {
+		repo.Seed, err = url.Parse(data.Seed)
+		if err == nil && repo.Seed.Scheme != "rsync" {
+			err = fmt.Errorf("unsupported scheme %q, expected \"rsync\"", repo.Seed.Scheme)
+		}
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid seed",
+				Detail:   fmt.Sprintf("Invalid seed: %q: %v", data.Seed, err),
+			})
+			return nil, diags
+		}
+	}
+	if data.SeedThreshold != nil {
+		repo.SeedThreshold = *data.SeedThreshold
+	}
+	switch data.Mode {
+	case "", ModeMirror:
+		repo.Mode = ModeMirror
+	case ModeArchive:
+		repo.Mode = ModeArchive
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid mode",
+			Detail:   fmt.Sprintf("Invalid mode %q, expected %q or %q.", data.Mode, ModeMirror, ModeArchive),
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	switch data.Downgrades {
+	case "":
+		repo.Downgrades = DowngradeWarn
+	case DowngradeAccept, DowngradeWarn, DowngradeHold:
+		repo.Downgrades = data.Downgrades
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid downgrades",
+			Detail:   fmt.Sprintf("Invalid downgrades %q, expected %q, %q or %q.", data.Downgrades, DowngradeAccept, DowngradeWarn, DowngradeHold),
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	if data.Snapshots != nil {
+		if *data.Snapshots < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid snapshots",
+				Detail:   fmt.Sprintf("Invalid snapshots: %d: must not be negative", *data.Snapshots),
+			})
+			return nil, diags
+		}
+		repo.Snapshots = *data.Snapshots
+	}
+	if data.ObsoleteMaxAge != "" {
+		if diags = append(diags, parseDuration("obsolete_max_age", data.ObsoleteMaxAge, nil, &repo.ObsoleteMaxAge)...); diags.HasErrors() {
+			return nil, diags
+		}
+		if repo.Mode == ModeArchive {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid obsolete_max_age",
+				Detail:   "Archive repositories never delete packages.",
+				Subject:  &block.DefRange,
+			})
+			return nil, diags
+		}
+	}
+	switch len(data.S3) {
+	case 0:
+	case 1:
+		repo.S3, diags = decodeS3Block(&hcl.Block{Type: "s3", Body: data.S3[0].Body, DefRange: block.DefRange}, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Duplicate s3 block",
+			Detail:   "A repository can only be published to one bucket.",
+			Subject:  &block.DefRange,
+		})
+		return nil, diags
+	}
+	if repo.Name == "" {
+		repo.Name = defaultName(repo.Upstream, repo.Architecture)
+	}
 	return repo, diags
 }
 
+// HostConfig configures the HTTP client of all upstreams on a host.
+type HostConfig struct {
+	Name                  string
+	Jobs                  int
+	MaxConnections        int
+	MaxIdleConnections    int
+	IdleTimeout           time.Duration
+	HTTP2                 bool
+	Proxy                 *url.URL
+	TLSCAFile             string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	// zero timeouts mean no limit
+	ConnectTimeout time.Duration
+	HeaderTimeout  time.Duration
+	Timeout        time.Duration
+	// a transfer below MinThroughput bytes per second for StallTimeout
+	// is aborted
+	StallTimeout  time.Duration
+	MinThroughput int64
+	Retries       int
+}
+
+const (
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultHeaderTimeout  = 1 * time.Minute
+	DefaultStallTimeout   = 1 * time.Minute
+	DefaultRetries        = 2
+)
+
+// Host returns the configuration for the upstream host name,
+// falling back to the defaults if the host is not configured.
+func (c *Config) Host(name string) *HostConfig {
+	if host, ok := c.Hosts[name]; ok {
+		return host
+	}
+	return &HostConfig{
+		Name:           name,
+		Jobs:           c.Jobs,
+		HTTP2:          true,
+		ConnectTimeout: DefaultConnectTimeout,
+		HeaderTimeout:  DefaultHeaderTimeout,
+		StallTimeout:   DefaultStallTimeout,
+		Retries:        DefaultRetries,
+	}
+}
+
+func decodeHostBlock(block *hcl.Block, ctx *hcl.EvalContext, jobs int) (*HostConfig, hcl.Diagnostics) {
+	var data struct {
+		Jobs                  *int   `hcl:"jobs,optional"`
+		MaxConnections        int    `hcl:"max_connections,optional"`
+		MaxIdleConnections    int    `hcl:"max_idle_connections,optional"`
+		IdleTimeout           string `hcl:"idle_timeout,optional"`
+		HTTP2                 *bool  `hcl:"http2,optional"`
+		Proxy                 string `hcl:"proxy,optional"`
+		TLSCAFile             string `hcl:"tls_ca_file,optional"`
+		TLSServerName         string `hcl:"tls_server_name,optional"`
+		TLSInsecureSkipVerify bool   `hcl:"tls_insecure_skip_verify,optional"`
+		ConnectTimeout        string `hcl:"connect_timeout,optional"`
+		HeaderTimeout         string `hcl:"header_timeout,optional"`
+		Timeout               string `hcl:"timeout,optional"`
+		StallTimeout          string `hcl:"stall_timeout,optional"`
+		MinThroughput         int64  `hcl:"min_throughput,optional"`
+		Retries               *int   `hcl:"retries,optional"`
+	}
+	diags := gohcl.DecodeBody(block.Body, ctx, &data)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	host := &HostConfig{
+		Name:                  block.Labels[0],
+		Jobs:                  jobs,
+		MaxConnections:        data.MaxConnections,
+		MaxIdleConnections:    data.MaxIdleConnections,
+		HTTP2:                 true,
+		TLSCAFile:             data.TLSCAFile,
+		TLSServerName:         data.TLSServerName,
+		TLSInsecureSkipVerify: data.TLSInsecureSkipVerify,
+		ConnectTimeout:        DefaultConnectTimeout,
+		HeaderTimeout:         DefaultHeaderTimeout,
+		StallTimeout:          DefaultStallTimeout,
+		MinThroughput:         data.MinThroughput,
+		Retries:               DefaultRetries,
+	}
+	if data.Jobs != nil {
+		host.Jobs = *data.Jobs
+	}
+	if data.HTTP2 != nil {
+		host.HTTP2 = *data.HTTP2
+	}
+	if data.Retries != nil {
+		host.Retries = *data.Retries
+	}
+	timeouts := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"connect_timeout", data.ConnectTimeout, &host.ConnectTimeout},
+		{"header_timeout", data.HeaderTimeout, &host.HeaderTimeout},
+		{"timeout", data.Timeout, &host.Timeout},
+		{"stall_timeout", data.StallTimeout, &host.StallTimeout},
+	}
+	for _, t := range timeouts {
+		if t.value == "" {
+			continue
+		}
+		if diags = append(diags, parseDuration(t.name, t.value, nil, t.dst)...); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if data.IdleTimeout != "" {
+		if diags = append(diags, parseDuration("idle_timeout", data.IdleTimeout, nil, &host.IdleTimeout)...); diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	if data.Proxy != "" {
+		proxy, err := url.Parse(data.Proxy)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid proxy",
+				Detail:   fmt.Sprintf("Invalid proxy: %q: %v", data.Proxy, err),
+			})
+			return nil, diags
+		}
+		host.Proxy = proxy
+	}
+	return host, diags
+}
+
 func (c *Config) Load(filename string) hcl.Diagnostics {
 	var file *hcl.File
 	var diags hcl.Diagnostics
@@ -169,17 +952,96 @@ func (c *Config) Load(filename string) hcl.Diagnostics {
 			{
 				Name: "jobs",
 			},
+			{
+				Name: "default_interval",
+			},
+			{
+				Name: "jitter",
+			},
+			{
+				Name: "tempfile_max_age",
+			},
+			{
+				Name: "tempfile_sweep_interval",
+			},
+			{
+				Name: "quarantine_max_age",
+			},
+			{
+				Name: "rsync_path",
+			},
 		},
 		Blocks: []hcl.BlockHeaderSchema{
 			{
 				Type: "repository",
 			},
+			{
+				Type:       "host",
+				LabelNames: []string{"name"},
+			},
+			{
+				Type: "webhook",
+			},
+			{
+				Type: "logging",
+			},
+			{
+				Type: "tracing",
+			},
+			{
+				Type: "health",
+			},
+			{
+				Type:       "hook",
+				LabelNames: []string{"name"},
+			},
 		},
 	})
 	if diags.HasErrors() {
 		return diags
 	}
 
+	c.Health = HealthConfig{
+		QueueThreshold:   DefaultQueueThreshold,
+		MaxMissedUpdates: DefaultMaxMissedUpdates,
+	}
+	for name, attr := range content.Attributes {
+		switch name {
+		case "jobs":
+			diags := gohcl.DecodeExpression(attr.Expr, &ctx, &c.Jobs)
+			if diags.HasErrors() {
+				return diags
+			}
+		case "default_interval":
+			if diags := decodePositiveDuration(attr, &ctx, &c.DefaultInterval); diags.HasErrors() {
+				return diags
+			}
+		case "jitter":
+			var jitter time.Duration
+			if diags := decodeDuration(attr, &ctx, &jitter); diags.HasErrors() {
+				return diags
+			}
+			c.Jitter = &jitter
+		case "tempfile_max_age":
+			if diags := decodeDuration(attr, &ctx, &c.TempMaxAge); diags.HasErrors() {
+				return diags
+			}
+		case "tempfile_sweep_interval":
+			if diags := decodePositiveDuration(attr, &ctx, &c.SweepInterval); diags.HasErrors() {
+				return diags
+			}
+		case "quarantine_max_age":
+			if diags := decodeDuration(attr, &ctx, &c.QuarantineMaxAge); diags.HasErrors() {
+				return diags
+			}
+		case "rsync_path":
+			diags := gohcl.DecodeExpression(attr.Expr, &ctx, &c.RsyncPath)
+			if diags.HasErrors() {
+				return diags
+			}
+		}
+
+	}
 	for _, block := range content.Blocks {
 		switch block.Type {
 		case "repository":
@@ -188,17 +1050,77 @@ func (c *Config) Load(filename string) hcl.Diagnostics {
 				return diags
 			}
 			c.Repositories = append(c.Repositories, repo)
-		}
-	}
-	for name, attr := range content.Attributes {
-		switch name {
-		case "jobs":
-			diags := gohcl.DecodeExpression(attr.Expr, &ctx, &c.Jobs)
+		case "host":
+			host, diags := decodeHostBlock(block, &ctx, c.Jobs)
 			if diags.HasErrors() {
 				return diags
 			}
+			if c.Hosts == nil {
+				c.Hosts = make(map[string]*HostConfig)
+			}
+			c.Hosts[host.Name] = host
+		case "webhook":
+			webhook, diags := decodeWebhookBlock(block, &ctx)
+			if diags.HasErrors() {
+				return diags
+			}
+			c.Webhook = webhook
+		case "logging":
+			logging, diags := decodeLoggingBlock(block, &ctx)
+			if diags.HasErrors() {
+				return diags
+			}
+			c.Logging = logging
+		case "tracing":
+			tracing, diags := decodeTracingBlock(block, &ctx)
+			if diags.HasErrors() {
+				return diags
+			}
+			c.Tracing = tracing
+		case "health":
+			health, diags := decodeHealthBlock(block, &ctx)
+			if diags.HasErrors() {
+				return diags
+			}
+			c.Health = health
+		case "hook":
+			hook, diags := decodeHookBlock(block, &ctx)
+			if diags.HasErrors() {
+				return diags
+			}
+			c.Hooks = append(c.Hooks, hook)
 		}
-
+	}
+	if c.Logging.Format == "" {
+		c.Logging = LoggingConfig{Format: "text", Level: "info"}
+	}
+	if c.DefaultInterval == 0 {
+		c.DefaultInterval = DefaultPollInterval
+	}
+	if c.RsyncPath == "" {
+		c.RsyncPath = "rsync"
+	}
+	for _, repo := range c.Repositories {
+		if repo.Interval == nil {
+			interval := c.DefaultInterval
+			repo.Interval = &interval
+		}
+		if repo.Jitter == nil {
+			jitter := *repo.Interval / 10
+			if c.Jitter != nil {
+				jitter = *c.Jitter
+			}
+			repo.Jitter = &jitter
+		}
+	}
+	if c.TempMaxAge == 0 {
+		c.TempMaxAge = DefaultTempMaxAge
+	}
+	if c.SweepInterval == 0 {
+		c.SweepInterval = DefaultSweepInterval
+	}
+	if c.QuarantineMaxAge == 0 {
+		c.QuarantineMaxAge = DefaultQuarantineMaxAge
 	}
 
 	if len(diags) > 0 {
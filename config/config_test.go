@@ -1,6 +1,11 @@
 package config
 
-import "testing"
+import (
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
 
 func TestLoad(t *testing.T) {
   var c Config
@@ -8,3 +13,223 @@ func TestLoad(t *testing.T) {
     t.Fatal(err)
   }
 }
+
+func TestLoadHosts(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/hosts.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  host := c.Host("repo-fi.voidlinux.org")
+  if host.Jobs != 4 || host.MaxConnections != 4 || host.HTTP2 {
+    t.Errorf("unexpected host config: %+v", host)
+  }
+  if host.Proxy == nil || host.Proxy.Host != "proxy.example.org:3128" {
+    t.Errorf("unexpected proxy: %v", host.Proxy)
+  }
+  other := c.Host("repo-de.voidlinux.org")
+  if other.Jobs != 8 || !other.HTTP2 {
+    t.Errorf("unexpected default host config: %+v", other)
+  }
+}
+
+func TestLoadSchedule(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/schedule.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if len(c.Repositories) != 3 {
+    t.Fatalf("expected 3 repositories, got %d", len(c.Repositories))
+  }
+  def, cron, trigger := c.Repositories[0], c.Repositories[1], c.Repositories[2]
+  if def.Interval == nil || *def.Interval != time.Minute {
+    t.Errorf("expected default interval, got %v", def.Interval)
+  }
+  if *def.Jitter != 6*time.Second {
+    t.Errorf("expected jitter of a tenth of the interval, got %v", *def.Jitter)
+  }
+  if cron.Schedule == nil || *cron.Jitter != 5*time.Second {
+    t.Errorf("unexpected schedule %v or jitter %v", cron.Schedule, *cron.Jitter)
+  }
+  if def.Name != "current/x86_64" {
+    t.Errorf("unexpected default name %q", def.Name)
+  }
+  if trigger.Poll {
+    t.Errorf("expected poll to be disabled")
+  }
+  if def.Seed != nil || def.SeedThreshold != DefaultSeedThreshold {
+    t.Errorf("unexpected seed %v with threshold %d", def.Seed, def.SeedThreshold)
+  }
+  if trigger.Seed == nil || trigger.Seed.Host != "repo-fi.voidlinux.org" || trigger.SeedThreshold != 100 {
+    t.Errorf("unexpected seed %v with threshold %d", trigger.Seed, trigger.SeedThreshold)
+  }
+  if c.RsyncPath != "rsync" {
+    t.Errorf("unexpected rsync_path %q", c.RsyncPath)
+  }
+}
+
+func TestLoadHooks(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/hooks.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if len(c.Hooks) != 2 {
+    t.Fatalf("expected 2 hooks, got %d", len(c.Hooks))
+  }
+  purge, status := c.Hooks[0], c.Hooks[1]
+  if purge.Name != "purge" || len(purge.Command) != 2 || purge.Timeout != DefaultHookTimeout {
+    t.Errorf("unexpected hook: %+v", purge)
+  }
+  if status.URL == nil || status.Retries != 3 || status.RetryDelay != time.Second || status.Headers["Authorization"] != "Bearer secret" {
+    t.Errorf("unexpected hook: %+v", status)
+  }
+  if err := loadString(t, `hook "purge" {
+  events = ["sync"]
+  command = ["true"]
+  retries = -1
+}`); err == nil {
+    t.Error("expected negative retries to be rejected")
+  }
+}
+
+func TestLoadStorage(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/storage.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  s3, local := c.Repositories[0], c.Repositories[1]
+  if s3.S3 == nil || s3.S3.Bucket != "voidlinux" || s3.S3.Prefix != "current" || s3.S3.PartSize != DefaultS3PartSize || s3.S3.Insecure {
+    t.Errorf("unexpected s3 config: %+v", s3.S3)
+  }
+  if s3.ObsoleteMaxAge != 24*time.Hour || s3.Snapshots != 7 {
+    t.Errorf("unexpected obsolete_max_age %v or snapshots %d", s3.ObsoleteMaxAge, s3.Snapshots)
+  }
+  if s3.Mode != ModeMirror || local.Mode != ModeArchive {
+    t.Errorf("unexpected modes %q and %q", s3.Mode, local.Mode)
+  }
+  if s3.Downgrades != DowngradeWarn || local.Downgrades != DowngradeHold {
+    t.Errorf("unexpected downgrades %q and %q", s3.Downgrades, local.Downgrades)
+  }
+  if local.S3 != nil || local.ObsoleteMaxAge != 0 || local.Snapshots != 0 {
+    t.Errorf("expected local storage keeping obsolete packages: %+v", local)
+  }
+}
+
+func TestLoadVerify(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/verify.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if c.QuarantineMaxAge != 72*time.Hour {
+    t.Errorf("unexpected quarantine_max_age %v", c.QuarantineMaxAge)
+  }
+  signed, unsigned := c.Repositories[0], c.Repositories[1]
+  if len(signed.TrustedKeys) != 1 || signed.TrustedKeys[0] != "/var/db/xbps/keys/*.plist" || !signed.IndexSignature || !signed.RequireSignatures {
+    t.Errorf("unexpected verification config: %+v", signed)
+  }
+  if unsigned.TrustedKeys != nil || unsigned.IndexSignature || unsigned.RequireSignatures {
+    t.Errorf("expected unverified repository: %+v", unsigned)
+  }
+}
+
+// loadString loads the configuration src and returns the error, if any.
+func loadString(t *testing.T, src string) error {
+  path := filepath.Join(t.TempDir(), "config.hcl")
+  if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+    t.Fatal(err)
+  }
+  var c Config
+  if diags := c.Load(path); diags.HasErrors() {
+    return diags
+  }
+  return nil
+}
+
+func TestLoadWebhook(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/webhook.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if c.Webhook == nil || c.Webhook.Path != "/trigger" || c.Webhook.Debounce != 10*time.Second || c.Webhook.MaxWait != 2*time.Minute {
+    t.Errorf("unexpected webhook config: %+v", c.Webhook)
+  }
+  if err := loadString(t, `webhook {
+  token = "token"
+  debounce = "2m"
+}`); err == nil {
+    t.Error("expected a max_wait shorter than the debounce to be rejected")
+  }
+}
+
+func TestLoadLogging(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/logging.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if c.Logging.Format != "journald" || c.Logging.Level != "debug" || c.Logging.File != "/var/log/void-mirror.log" || c.Logging.Source {
+    t.Errorf("unexpected logging config: %+v", c.Logging)
+  }
+  var d Config
+  if err := d.Load("fixtures/webhook.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if d.Logging.Format != "text" || d.Logging.Level != "info" {
+    t.Errorf("unexpected default logging config: %+v", d.Logging)
+  }
+  for _, src := range []string{
+    `logging { format = "xml" }`,
+    `logging { level = "trace" }`,
+  } {
+    if err := loadString(t, src); err == nil {
+      t.Errorf("%s: expected error", src)
+    }
+  }
+}
+
+func TestLoadTracing(t *testing.T) {
+  var c Config
+  if err := c.Load("fixtures/tracing.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  tracing := c.Tracing
+  if tracing == nil || tracing.Endpoint != "collector:4318" || !tracing.Insecure || tracing.SampleRatio != 0.25 || tracing.ServiceName != "void-mirror" {
+    t.Fatalf("unexpected tracing config: %+v", tracing)
+  }
+  if tracing.Headers["Authorization"] != "Bearer secret" {
+    t.Errorf("unexpected tracing headers: %v", tracing.Headers)
+  }
+  var d Config
+  if err := d.Load("fixtures/webhook.hcl"); err != nil {
+    t.Fatal(err)
+  }
+  if d.Tracing != nil {
+    t.Errorf("expected tracing to be disabled, got %+v", d.Tracing)
+  }
+  if err := loadString(t, `tracing { sample_ratio = 2 }`); err == nil {
+    t.Error("expected a sample_ratio above 1 to be rejected")
+  }
+}
+
+func TestLoadSweepInterval(t *testing.T) {
+  for _, interval := range []string{"0s", "-1m"} {
+    if err := loadString(t, `tempfile_sweep_interval = "`+interval+`"`); err == nil {
+      t.Errorf("%s: expected error", interval)
+    }
+  }
+}
+
+func TestLoadInterval(t *testing.T) {
+  for _, src := range []string{
+    `default_interval = "0s"`,
+    `default_interval = "-1m"`,
+    `repository {
+  upstream = "https://repo-fi.voidlinux.org/current"
+  architecture = "x86_64"
+  destination = "/srv/current"
+  interval = "0s"
+}`,
+  } {
+    if err := loadString(t, src); err == nil {
+      t.Errorf("%s: expected error", src)
+    }
+  }
+}
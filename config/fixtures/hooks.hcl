@@ -0,0 +1,15 @@
+hook "purge" {
+  events = ["sync"]
+  command = ["/usr/local/bin/purge-cdn", "--all"]
+}
+
+hook "status" {
+  events = ["packages", "error"]
+  url = "https://status.example.org/api/mirror"
+  headers = {
+    Authorization = "Bearer secret"
+  }
+  timeout = "5s"
+  retries = 3
+  retry_delay = "1s"
+}
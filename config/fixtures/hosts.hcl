@@ -0,0 +1,16 @@
+jobs = 8
+
+host "repo-fi.voidlinux.org" {
+  jobs = 4
+  max_connections = 4
+  idle_timeout = "30s"
+  http2 = false
+  proxy = "http://proxy.example.org:3128"
+}
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current"
+  interval = "30s"
+  architecture = "x86_64"
+  destination = "/srv/www/current"
+}
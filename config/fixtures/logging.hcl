@@ -0,0 +1,5 @@
+logging {
+  format = "journald"
+  level = "debug"
+  file = "/var/log/void-mirror.log"
+}
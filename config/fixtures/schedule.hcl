@@ -0,0 +1,24 @@
+default_interval = "1m"
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current"
+  architecture = "x86_64"
+  destination = "/srv/www/current"
+}
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current/musl"
+  architecture = "x86_64-musl"
+  destination = "/srv/www/current/musl"
+  schedule = "*/15 * * * *"
+  jitter = "5s"
+}
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current/aarch64"
+  architecture = "aarch64"
+  destination = "/srv/www/current/aarch64"
+  poll = false
+  seed = "rsync://repo-fi.voidlinux.org/voidlinux/current/aarch64"
+  seed_threshold = 100
+}
@@ -0,0 +1,23 @@
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current"
+  architecture = "x86_64"
+  destination = "/var/cache/void-mirror/current"
+  obsolete_max_age = "24h"
+  snapshots = 7
+
+  s3 {
+    endpoint = "minio.example.org:9000"
+    bucket = "voidlinux"
+    prefix = "/current/"
+    access_key = "access"
+    secret_key = "secret"
+  }
+}
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current/musl"
+  architecture = "x86_64-musl"
+  destination = "/srv/www/current/musl"
+  mode = "archive"
+  downgrades = "hold"
+}
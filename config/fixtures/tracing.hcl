@@ -0,0 +1,8 @@
+tracing {
+  endpoint = "collector:4318"
+  insecure = true
+  headers = {
+    Authorization = "Bearer secret"
+  }
+  sample_ratio = 0.25
+}
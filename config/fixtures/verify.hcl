@@ -0,0 +1,16 @@
+quarantine_max_age = "72h"
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current"
+  architecture = "x86_64"
+  destination = "/srv/www/current"
+  trusted_keys = ["/var/db/xbps/keys/*.plist"]
+  index_signature = true
+  require_signatures = true
+}
+
+repository {
+  upstream = "https://repo-fi.voidlinux.org/current/musl"
+  architecture = "x86_64-musl"
+  destination = "/srv/www/current/musl"
+}
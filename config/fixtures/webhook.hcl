@@ -0,0 +1,5 @@
+webhook {
+  token = "token"
+  debounce = "10s"
+  max_wait = "2m"
+}
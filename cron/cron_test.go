@@ -0,0 +1,58 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2023, time.May, 31, 23, 58, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2023, time.May, 31, 23, 59, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2023, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2023, time.June, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"15 10 * * 1-5", time.Date(2023, time.June, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2023, time.June, 4, 12, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2023, time.June, 2, 0, 0, 0, 0, time.UTC)},
+		{"10,20 3-4/1 * 6 *", time.Date(2023, time.June, 1, 3, 10, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// a day of month or week starting with * does not restrict, both
+		// have to match
+		{"0 0 */2 * 1", time.Date(2023, time.June, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 3 * */2", time.Date(2023, time.June, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(base); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/void-linux/void-mirror/reqextra"
+	"github.com/void-linux/void-mirror/sched"
+)
+
+// queue downloads the named file and stores it if it matches sum and check
+// accepts it, both may be nil. Staged files are kept for publish instead
+// and never shared, other callers of the same file join its download.
+func (r *Repository) queue(ctx context.Context, name string, sum digest, size int64, check checkFunc, staged *stagedIndex) *download {
+	path := filepath.Join(r.Config.Destination, name)
+	d, joined := newDownload(check), false
+	if staged == nil {
+		d, joined = downloads.start(path, sum, check)
+	}
+	if joined {
+		queue_deduplicated_total.Inc()
+		r.log.Debug("download already queued", "path", path)
+		trace.SpanFromContext(ctx).AddEvent("download joined",
+			trace.WithAttributes(attribute.String("path", path)))
+		return d
+	}
+	// the download outlives the update that queued it, it only inherits
+	// the trace from ctx but is canceled with the repository.
+	_, span := tracer.Start(ctx, "download", trace.WithAttributes(
+		attribute.String("path", path),
+		attribute.Int64("size", size),
+	))
+	dctx := trace.ContextWithSpan(r.ctx, span)
+	_, queued := tracer.Start(dctx, "queue")
+	r.host.sched.Submit(&sched.Job{
+		Group: r.Config.Name,
+		Size:  size,
+		Run: func() {
+			queued.End()
+			var err error
+			defer func() {
+				// waiters must not block on a download that panicked
+				if v := recover(); v != nil {
+					err = fmt.Errorf("download panicked: %v", v)
+					defer panic(v)
+				}
+				downloads.finish(path, sum, d, err)
+				endSpan(span, err)
+			}()
+			running := queue_running.WithLabelValues(r.host.name)
+			running.Inc()
+			defer running.Dec()
+			var tmpfile string
+			pattern := fmt.Sprintf(".%s.*", name)
+			if staged != nil {
+				pattern += stagedSuffix
+			}
+			handler := reqextra.ToTemp(r.Config.Destination, pattern, &tmpfile)
+			if sum != nil {
+				handler = reqextra.Sha256Verify(sum, handler)
+			}
+			req := r.upstream.Request(name).Handle(handler)
+			url, err := req.URL()
+			if err != nil {
+				r.log.Error("url error", "error", err)
+				return
+			}
+			r.log.Info("downloading", "url", url)
+			tctx, transfer := tracer.Start(dctx, "transfer")
+			err = r.upstream.Fetch(tctx, req)
+			endSpan(transfer, err)
+			var mismatch *reqextra.ChecksumError
+			if errors.As(err, &mismatch) && tmpfile != "" {
+				r.quarantine(tmpfile, &quarantined{
+					Name:     name,
+					Reason:   quarantineChecksum,
+					URL:      url.String(),
+					Headers:  mismatch.Response.Header,
+					Expected: hex.EncodeToString(mismatch.Expected),
+					Actual:   hex.EncodeToString(mismatch.Got),
+					Error:    err.Error(),
+				})
+			}
+			if err != nil {
+				r.log.Error("donwloading", "url", url, "error", err)
+			} else if err = downloads.check(dctx, d, tmpfile); err != nil {
+				r.log.Error("rejected download", "url", url, "error", err)
+			}
+			if err == nil && staged != nil {
+				staged.path = tmpfile
+				tmpfile = ""
+			} else if err == nil {
+				sctx, store := tracer.Start(dctx, "store")
+				err = r.storage.Put(sctx, name, tmpfile, sum)
+				endSpan(store, err)
+				if err != nil {
+					r.log.Error("storing", "name", name, "error", err)
+				}
+			}
+			if tmpfile != "" {
+				os.Remove(tmpfile)
+			}
+		},
+	})
+	return d
+}
+
+func (r *Repository) queuePkg(ctx context.Context, pkg *pkg, staged *stagedIndex) error {
+	var check checkFunc
+	if r.Config.RequireSignatures {
+		key := r.signingKey()
+		// the signature is small, it is fetched again by its own download
+		check = func(ctx context.Context, path string) error {
+			return r.fetchSig(ctx, key, pkg)
+		}
+	}
+	d := r.queue(ctx, pkg.Filename(), pkg.SHA256, pkg.Size, check, staged)
+	r.addPending(d, pkg, false, staged)
+	return nil
+}
+
+func (r *Repository) queueSig(ctx context.Context, pkg *pkg, staged *stagedIndex) error {
+	var check checkFunc
+	if key := r.signingKey(); key != nil || r.Config.RequireSignatures {
+		check = func(ctx context.Context, path string) error {
+			return r.checkSig(key, pkg, path)
+		}
+	}
+	d := r.queue(ctx, pkg.Filename()+".sig", nil, 0, check, staged)
+	r.addPending(d, pkg, true, staged)
+	return nil
+}
+
+// addPending adds d to the downloads of the update. Failed downloads that
+// are not staged hold back the indexes and are retried by the next update,
+// signatures only if they are required.
+func (r *Repository) addPending(d *download, pkg *pkg, sig bool, staged *stagedIndex) {
+	p := pendingDownload{d: d}
+	if staged == nil && (!sig || r.Config.RequireSignatures) {
+		p.pkg, p.sig = pkg, sig
+	}
+	r.pending = append(r.pending, p)
+}
+
+// refetch stages a package rebuilt upstream with the same pkgver and its
+// signature, they replace the stored files when the indexes are published.
+func (r *Repository) refetch(ctx context.Context, pkg *pkg) []*stagedIndex {
+	r.log.Info("package was rebuilt", "pkgver", pkg.Pkgver, "sha256", hex.EncodeToString(pkg.SHA256))
+	binpkg := &stagedIndex{name: pkg.Filename(), rebuilt: pkg}
+	sig := &stagedIndex{name: pkg.Filename() + ".sig", rebuilt: pkg}
+	r.queuePkg(ctx, pkg, binpkg)
+	r.queueSig(ctx, pkg, sig)
+	return []*stagedIndex{binpkg, sig}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// status is the health of a repository, it is updated by the repository's
+// Run loop and read by the health endpoints.
+type status struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastSuccess time.Time
+	lastError   error
+	lastFailure time.Time
+	failures    int
+	exited      bool
+	exitErr     error
+}
+
+func (s *status) updated(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastError = err
+		s.lastFailure = time.Now()
+		s.failures++
+		return
+	}
+	s.lastSuccess = time.Now()
+	s.failures = 0
+}
+
+func (s *status) exit(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exited = true
+	s.exitErr = err
+}
+
+// staleAfter returns the time after which a repository that last updated
+// successfully at last has missed n polls, or the zero time if the
+// repository is not polled.
+func staleAfter(conf *config.RepositoryConfig, last time.Time, n int) time.Time {
+	if !conf.Poll {
+		return time.Time{}
+	}
+	t := last
+	for i := 0; i < n; i++ {
+		if conf.Schedule != nil {
+			t = conf.Schedule.Next(t)
+			if t.IsZero() {
+				return t
+			}
+		} else {
+			t = t.Add(*conf.Interval)
+		}
+	}
+	return t.Add(*conf.Jitter)
+}
+
+type repositoryHealth struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	Ready       bool       `json:"ready"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Degraded    bool       `json:"degraded,omitempty"`
+	Failures    int        `json:"consecutive_failures,omitempty"`
+	Exited      bool       `json:"exited,omitempty"`
+	Problem     string     `json:"problem,omitempty"`
+}
+
+func (r *Repository) health(now time.Time, maxMissed int) repositoryHealth {
+	s := &r.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := repositoryHealth{
+		Name:     r.Config.Name,
+		Healthy:  true,
+		Ready:    !s.lastSuccess.IsZero(),
+		Degraded: s.failures > 0,
+		Failures: s.failures,
+		Exited:   s.exited,
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		h.LastSuccess = &t
+	}
+	if s.lastError != nil {
+		t := s.lastFailure
+		h.LastFailure = &t
+		h.LastError = s.lastError.Error()
+	}
+	switch {
+	case s.exited:
+		h.Healthy = false
+		h.Problem = "update loop exited"
+		if s.exitErr != nil {
+			h.Problem += ": " + s.exitErr.Error()
+		}
+	case h.Degraded:
+		h.Problem = "last update failed"
+	case !h.Ready:
+		h.Problem = "no successful update yet"
+	}
+	if !s.exited {
+		since := s.lastSuccess
+		if since.IsZero() {
+			since = s.started
+		}
+		if stale := staleAfter(r.Config, since, maxMissed); !stale.IsZero() && now.After(stale) {
+			h.Healthy = false
+			h.Problem = "no successful update since " + since.Format(time.RFC3339)
+		}
+	}
+	return h
+}
+
+// healthChecker serves the /healthz and /readyz endpoints.
+type healthChecker struct {
+	conf  *config.HealthConfig
+	repos []*Repository
+}
+
+type healthReport struct {
+	OK           bool               `json:"ok"`
+	QueueWaiting int                `json:"queue_waiting"`
+	Repositories []repositoryHealth `json:"repositories"`
+}
+
+func (hc *healthChecker) report() healthReport {
+	now := time.Now()
+	var rep healthReport
+	for _, host := range hosts {
+		rep.QueueWaiting += host.sched.WaitingQueueSize()
+	}
+	for _, repo := range hc.repos {
+		rep.Repositories = append(rep.Repositories, repo.health(now, hc.conf.MaxMissedUpdates))
+	}
+	return rep
+}
+
+func writeReport(w http.ResponseWriter, rep healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !rep.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(rep)
+}
+
+// healthz fails if any repository's update loop exited or did not update
+// successfully within the configured number of intervals.
+func (hc *healthChecker) healthz(w http.ResponseWriter, r *http.Request) {
+	rep := hc.report()
+	rep.OK = true
+	for _, repo := range rep.Repositories {
+		if !repo.Healthy {
+			rep.OK = false
+		}
+	}
+	writeReport(w, rep)
+}
+
+// readyz succeeds once every repository updated successfully and the
+// download queue drained below the configured threshold.
+func (hc *healthChecker) readyz(w http.ResponseWriter, r *http.Request) {
+	rep := hc.report()
+	rep.OK = rep.QueueWaiting <= hc.conf.QueueThreshold
+	for _, repo := range rep.Repositories {
+		if !repo.Ready || repo.Exited {
+			rep.OK = false
+		}
+	}
+	writeReport(w, rep)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRepositoryHealth(t *testing.T) {
+	repo := testRepository(t, "https://repo-fi.voidlinux.org/current", "x86_64")
+	interval, jitter := time.Minute, time.Duration(0)
+	repo.Config.Interval = &interval
+	repo.Config.Jitter = &jitter
+	repo.Config.Poll = true
+	now := time.Now()
+	repo.status.started = now.Add(-2 * time.Minute)
+
+	h := repo.health(now, 3)
+	if !h.Healthy || h.Ready {
+		t.Errorf("expected healthy and not ready before the first update: %+v", h)
+	}
+	if h := repo.health(now.Add(2*time.Minute), 3); h.Healthy {
+		t.Errorf("expected unhealthy without an update within 3 intervals: %+v", h)
+	}
+
+	repo.status.updated(nil)
+	repo.status.updated(errors.New("transient"))
+	h = repo.health(time.Now(), 3)
+	if !h.Healthy || !h.Ready || h.LastError != "transient" {
+		t.Errorf("expected healthy and ready after an update: %+v", h)
+	}
+	if !h.Degraded || h.Failures != 1 {
+		t.Errorf("expected degraded after a failed update: %+v", h)
+	}
+	repo.status.updated(nil)
+	if h := repo.health(time.Now(), 3); h.Degraded || h.Failures != 0 {
+		t.Errorf("expected not degraded after a successful update: %+v", h)
+	}
+	if h := repo.health(time.Now().Add(4*time.Minute), 3); h.Healthy {
+		t.Errorf("expected unhealthy after missing 3 intervals: %+v", h)
+	}
+
+	repo.status.exit(errors.New("boom"))
+	if h := repo.health(time.Now(), 3); h.Healthy {
+		t.Errorf("expected unhealthy after the update loop exited: %+v", h)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// event is the JSON document passed to hooks.
+type event struct {
+	Event        string    `json:"event"`
+	Repository   string    `json:"repository"`
+	Architecture string    `json:"architecture"`
+	Upstream     string    `json:"upstream"`
+	Destination  string    `json:"destination"`
+	Time         time.Time `json:"time"`
+	Added        []string  `json:"added,omitempty"`
+	Deleted      []string  `json:"deleted,omitempty"`
+	Rebuilt      []string  `json:"rebuilt,omitempty"`
+	Failed       int       `json:"failed_downloads,omitempty"`
+	File         string    `json:"file,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func newEvent(name string, conf *config.RepositoryConfig) *event {
+	return &event{
+		Event:        name,
+		Repository:   conf.Name,
+		Architecture: conf.Architecture,
+		Upstream:     conf.Upstream.String(),
+		Destination:  conf.Destination,
+		Time:         time.Now(),
+	}
+}
+
+// hookQueueSize is the number of events buffered per hook, events are
+// dropped if a hook falls behind further.
+const hookQueueSize = 64
+
+type hook struct {
+	conf  *config.HookConfig
+	queue chan *event
+}
+
+func newHook(conf *config.HookConfig) *hook {
+	return &hook{conf: conf, queue: make(chan *event, hookQueueSize)}
+}
+
+func (h *hook) wants(ev *event) bool {
+	found := false
+	for _, name := range h.conf.Events {
+		if name == ev.Event {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if len(h.conf.Repositories) == 0 {
+		return true
+	}
+	for _, name := range h.conf.Repositories {
+		if name == ev.Repository {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hook) exec(ctx context.Context, ev *event, body []byte) error {
+	cmd := exec.CommandContext(ctx, h.conf.Command[0], h.conf.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"VOID_MIRROR_EVENT="+ev.Event,
+		"VOID_MIRROR_REPOSITORY="+ev.Repository,
+		"VOID_MIRROR_ARCHITECTURE="+ev.Architecture,
+		"VOID_MIRROR_DESTINATION="+ev.Destination,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (h *hook) post(ctx context.Context, body []byte) error {
+	rb := requests.URL(h.conf.URL.String()).
+		BodyBytes(body).
+		ContentType("application/json")
+	for key, value := range h.conf.Headers {
+		rb.Header(key, value)
+	}
+	return rb.Fetch(ctx)
+}
+
+func (h *hook) deliverOnce(ctx context.Context, ev *event, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, h.conf.Timeout)
+	defer cancel()
+	if h.conf.URL != nil {
+		return h.post(ctx, body)
+	}
+	return h.exec(ctx, ev, body)
+}
+
+func (h *hook) deliver(ctx context.Context, ev *event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = h.deliverOnce(ctx, ev, body)
+		if err == nil || attempt >= h.conf.Retries {
+			return err
+		}
+		slog.Warn("hook failed, retrying",
+			"hook", h.conf.Name,
+			"event", ev.Event,
+			"repository", ev.Repository,
+			"attempt", attempt+1,
+			"error", err,
+		)
+		select {
+		case <-time.After(h.conf.RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (h *hook) handle(ctx context.Context, ev *event) {
+	if err := h.deliver(ctx, ev); err != nil {
+		hook_runs_total.WithLabelValues(h.conf.Name, "failure").Inc()
+		slog.Error("hook failed",
+			"hook", h.conf.Name,
+			"event", ev.Event,
+			"repository", ev.Repository,
+			"error", err,
+		)
+		return
+	}
+	hook_runs_total.WithLabelValues(h.conf.Name, "success").Inc()
+}
+
+func (h *hook) Run(ctx context.Context) error {
+	for {
+		select {
+		case ev := <-h.queue:
+			h.handle(ctx, ev)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// flush delivers the queued events and returns once the queue is empty.
+// One-shot syncs use it instead of Run.
+func (h *hook) flush(ctx context.Context) {
+	for {
+		select {
+		case ev := <-h.queue:
+			h.handle(ctx, ev)
+		default:
+			return
+		}
+	}
+}
+
+var hooks []*hook
+
+// emit queues ev for all hooks interested in it without blocking.
+func emit(ev *event) {
+	for _, h := range hooks {
+		if !h.wants(ev) {
+			continue
+		}
+		select {
+		case h.queue <- ev:
+		default:
+			hook_runs_total.WithLabelValues(h.conf.Name, "dropped").Inc()
+			slog.Warn("hook queue full, dropping event",
+				"hook", h.conf.Name,
+				"event", ev.Event,
+				"repository", ev.Repository,
+			)
+		}
+	}
+}
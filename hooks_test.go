@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+func TestHookRetry(t *testing.T) {
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	// the hook fails on its first run and records the event it got
+	script := `n=$(cat "$0" 2>/dev/null || echo 0); echo $((n+1)) > "$0"; cat > "$0.json"; [ "$n" -ge 1 ]`
+	h := newHook(&config.HookConfig{
+		Name:       "test",
+		Events:     []string{config.EventSync},
+		Command:    []string{"sh", "-c", script, count},
+		Timeout:    5 * time.Second,
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	})
+	hooks = []*hook{h}
+	defer func() { hooks = nil }()
+
+	conf := &config.RepositoryConfig{
+		Name:         "current/x86_64",
+		Upstream:     &url.URL{Scheme: "https", Host: "repo-fi.voidlinux.org", Path: "/current"},
+		Architecture: "x86_64",
+	}
+	emit(newEvent(config.EventSync, conf))
+	// not wanted by the hook
+	emit(newEvent(config.EventError, conf))
+	h.flush(context.Background())
+
+	data, err := os.ReadFile(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2\n" {
+		t.Errorf("expected the hook to run twice, ran %q", data)
+	}
+	data, err = os.ReadFile(count + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != config.EventSync || ev.Repository != "current/x86_64" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if len(h.queue) != 0 {
+		t.Errorf("expected the queue to be flushed, %d events left", len(h.queue))
+	}
+}
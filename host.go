@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/void-linux/void-mirror/config"
+	"github.com/void-linux/void-mirror/reqextra"
+	"github.com/void-linux/void-mirror/sched"
+)
+
+// host holds the HTTP transport and download queue shared by all
+// repositories with upstreams on the same host, so that a slow upstream
+// only occupies its own workers.
+type host struct {
+	name      string
+	jobs      int
+	transport http.RoundTripper
+	sched     *sched.Scheduler
+	timeout   time.Duration
+	retries   int
+}
+
+func newTransport(conf *config.HostConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   conf.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = dialer.DialContext
+		t.TLSHandshakeTimeout = conf.ConnectTimeout
+	}
+	t.ResponseHeaderTimeout = conf.HeaderTimeout
+	t.MaxConnsPerHost = conf.MaxConnections
+	if conf.MaxIdleConnections > 0 {
+		t.MaxIdleConnsPerHost = conf.MaxIdleConnections
+	}
+	if conf.IdleTimeout > 0 {
+		t.IdleConnTimeout = conf.IdleTimeout
+	}
+	if conf.Proxy != nil {
+		t.Proxy = http.ProxyURL(conf.Proxy)
+	}
+	if !conf.HTTP2 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	t.TLSClientConfig = &tls.Config{
+		ServerName:         conf.TLSServerName,
+		InsecureSkipVerify: conf.TLSInsecureSkipVerify,
+	}
+	if conf.TLSCAFile != "" {
+		pem, err := os.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.TLSCAFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return t, nil
+}
+
+func newHost(conf *config.HostConfig) (*host, error) {
+	t, err := newTransport(conf)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", conf.Name, err)
+	}
+	jobs := conf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	minBytes := int64(float64(conf.MinThroughput) * conf.StallTimeout.Seconds())
+	return &host{
+		name: conf.Name,
+		jobs: jobs,
+		transport: reqextra.TraceTransport(
+			requests.LogTransport(reqextra.Watchdog(t, conf.StallTimeout, minBytes), requestLogger),
+			tracer,
+		),
+		sched:   sched.New(jobs),
+		timeout: conf.Timeout,
+		retries: conf.Retries,
+	}, nil
+}
+
+// timeoutKind classifies err by the timeout that caused it,
+// it returns an empty string if err is not a timeout.
+func timeoutKind(err error) string {
+	if err == nil {
+		return ""
+	}
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, reqextra.ErrStalled):
+		return "stall"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "overall"
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return "connect"
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return "connect"
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return "header"
+	}
+	return ""
+}
+
+// fetch performs the request with the host's overall timeout and retries
+// it with an exponential backoff if it timed out.
+func (h *host) fetch(ctx context.Context, rb *requests.Builder) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = h.fetchOnce(ctx, rb)
+		kind := timeoutKind(err)
+		if kind == "" || ctx.Err() != nil {
+			return err
+		}
+		download_timeouts_total.WithLabelValues(h.name, kind).Inc()
+		if attempt >= h.retries {
+			return err
+		}
+		backoff := time.Second << attempt
+		slog.Warn("request timed out, retrying",
+			"host", h.name,
+			"timeout", kind,
+			"attempt", attempt+1,
+			"backoff", backoff,
+			"error", err,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (h *host) fetchOnce(ctx context.Context, rb *requests.Builder) error {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	return rb.Fetch(ctx)
+}
+
+// hosts maps upstream host names to their shared client and queue.
+var hosts = make(map[string]*host)
+
+// getHost returns the host for name, creating it from conf if necessary.
+func getHost(conf *config.Config, name string) (*host, error) {
+	if h, ok := hosts[name]; ok {
+		return h, nil
+	}
+	h, err := newHost(conf.Host(name))
+	if err != nil {
+		return nil, err
+	}
+	hosts[name] = h
+	queue_workers.WithLabelValues(name).Set(float64(h.jobs))
+	return h, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/void-linux/void-mirror/config"
+	"github.com/void-linux/void-mirror/reqextra"
+	"github.com/void-linux/void-mirror/sched"
+)
+
+func TestHostConcurrency(t *testing.T) {
+	var running, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	h, err := newHost(&config.HostConfig{Name: "test", Jobs: 2, MaxConnections: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.sched.Stop()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		h.sched.Submit(&sched.Job{Group: "test", Run: func() {
+			defer wg.Done()
+			errs <- h.fetch(context.Background(), requests.URL(srv.URL).Transport(h.transport))
+		}})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak != 2 {
+		t.Errorf("expected 2 concurrent downloads, got %d", peak)
+	}
+}
+
+func TestHostStallTimeout(t *testing.T) {
+	// the body trickles in slower than the minimum throughput
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 40; i++ {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	h, err := newHost(&config.HostConfig{
+		Name:          "test",
+		Jobs:          1,
+		StallTimeout:  200 * time.Millisecond,
+		MinThroughput: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.sched.Stop()
+	var body string
+	err = h.fetchOnce(context.Background(), requests.URL(srv.URL).Transport(h.transport).ToString(&body))
+	if !errors.Is(err, reqextra.ErrStalled) {
+		t.Errorf("expected the download to stall, got %v", err)
+	}
+}
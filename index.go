@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/carlmjohnson/requests"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/Duncaen/go-xbps/repo"
+	"github.com/Duncaen/go-xbps/repo/repodata"
+	"github.com/Duncaen/go-xbps/util"
+	"github.com/Duncaen/go-xbps/version"
+
+	"github.com/void-linux/void-mirror/config"
+	"github.com/void-linux/void-mirror/reqextra"
+)
+
+type Stagedata struct {
+	config   *config.RepositoryConfig
+	upstream upstream
+	// staged is the fetched stagedata waiting to be published
+	staged   *stagedIndex
+	// verifier checks the signer of fetched stagedata, if it is set
+	verifier *verifier
+	// key is the public key the stagedata is signed with
+	key      *repo.PublicKey
+	log    *slog.Logger
+	req    *http.Request
+	index  index
+	ETag string
+	LastModified string
+}
+
+func NewStagedata(config *config.RepositoryConfig, upstream upstream, verifier *verifier, log *slog.Logger) (*Stagedata, error) {
+	url := config.Upstream.JoinPath(fmt.Sprintf("%s-stagedata", config.Architecture))
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	file := fmt.Sprintf("%s-stagedata", config.Architecture)
+	idx, key, err := readRepodata(filepath.Join(config.Destination, file))
+	if err != nil {
+		return nil, err
+	}
+	return &Stagedata{config: config, upstream: upstream, verifier: verifier, log: log, req: req, index: idx, key: key}, nil
+}
+
+type digest []byte
+
+func (h *digest) UnmarshalPlist(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("could not decode digest: %v", err)
+	}
+	*h = data
+	return nil
+}
+
+// pkg is a package from {repo,stage}data with the metadata fields we care for.
+type pkg struct {
+	Pkgver string `plist:"pkgver"`
+	Arch   string `plist:"architecture"`
+	SHA256 digest `plist:"filename-sha256"`
+	Size   int64  `plist:"filename-size"`
+}
+
+func (pkg pkg) Filename() string {
+	return fmt.Sprintf("%s.%s.xbps", pkg.Pkgver, pkg.Arch)
+}
+
+// index is the repository index
+type index map[string]*pkg
+
+// pkgUpdate is a package that changed between two indexes.
+type pkgUpdate struct {
+	Old *pkg
+	New *pkg
+}
+
+type indexDiff struct {
+	// Added and Deleted are the package files that are added to and
+	// deleted from the repository, they include upgrades and downgrades.
+	Added   []*pkg
+	Deleted []*pkg
+	// Upgraded and Downgraded are the packages whose version changed,
+	// Rebuilt are the packages with the same version but a different
+	// sha256.
+	Upgraded   []pkgUpdate
+	Downgraded []pkgUpdate
+	Rebuilt    []pkgUpdate
+}
+
+// Diff returns the changes from idx to other. Versions are compared with
+// the xbps rules, a changed pkgver that compares equal is an upgrade.
+func (idx index) Diff(other index) indexDiff {
+	var d indexDiff
+	for name, newpkg := range other {
+		oldpkg, ok := idx[name]
+		if !ok {
+			d.Added = append(d.Added, newpkg)
+		} else if newpkg.Pkgver != oldpkg.Pkgver {
+			d.Added = append(d.Added, newpkg)
+			d.Deleted = append(d.Deleted, oldpkg)
+			_, oldVersion := splitPkgver(oldpkg.Pkgver)
+			_, newVersion := splitPkgver(newpkg.Pkgver)
+			if version.Cmp(newVersion, oldVersion) < 0 {
+				d.Downgraded = append(d.Downgraded, pkgUpdate{oldpkg, newpkg})
+			} else {
+				d.Upgraded = append(d.Upgraded, pkgUpdate{oldpkg, newpkg})
+			}
+		} else if oldpkg.SHA256 != nil && newpkg.SHA256 != nil && !bytes.Equal(oldpkg.SHA256, newpkg.SHA256) {
+			d.Rebuilt = append(d.Rebuilt, pkgUpdate{oldpkg, newpkg})
+		}
+	}
+	for name, pkg := range idx {
+		if _, ok := other[name]; !ok {
+			d.Deleted = append(d.Deleted, pkg)
+		}
+	}
+	return d
+}
+
+// diff is Diff recorded as span name.
+func (idx index) diff(ctx context.Context, name string, other index) indexDiff {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	d := idx.Diff(other)
+	span.SetAttributes(
+		attribute.Int("packages", len(other)),
+		attribute.Int("added", len(d.Added)),
+		attribute.Int("deleted", len(d.Deleted)),
+		attribute.Int("upgraded", len(d.Upgraded)),
+		attribute.Int("downgraded", len(d.Downgraded)),
+		attribute.Int("rebuilt", len(d.Rebuilt)),
+	)
+	return d
+}
+
+// countChanges counts the packages changed by diff of the index file by
+// class.
+func countChanges(conf *config.RepositoryConfig, file string, diff *indexDiff) {
+	updated := len(diff.Upgraded) + len(diff.Downgraded)
+	for _, c := range []struct {
+		class string
+		count int
+	}{
+		{"added", len(diff.Added) - updated},
+		{"removed", len(diff.Deleted) - updated},
+		{"upgraded", len(diff.Upgraded)},
+		{"downgraded", len(diff.Downgraded)},
+		{"rebuilt", len(diff.Rebuilt)},
+	} {
+		if c.count > 0 {
+			package_changes_total.WithLabelValues(conf.Name, file, c.class).Add(float64(c.count))
+		}
+	}
+}
+
+// checkDowngrades applies the downgrade policy of conf to diff of the
+// index file and reports whether the index must be held back.
+func checkDowngrades(conf *config.RepositoryConfig, log *slog.Logger, file string, diff *indexDiff) bool {
+	if len(diff.Downgraded) == 0 || conf.Downgrades == config.DowngradeAccept {
+		return false
+	}
+	downgraded := make([]string, 0, len(diff.Downgraded))
+	for _, u := range diff.Downgraded {
+		downgraded = append(downgraded, fmt.Sprintf("%s -> %s", u.Old.Pkgver, u.New.Pkgver))
+	}
+	sort.Strings(downgraded)
+	if conf.Downgrades == config.DowngradeHold {
+		index_updates_held_total.WithLabelValues(conf.Name, file).Inc()
+		log.Error("holding back index that downgrades packages", "index", file, "downgraded", downgraded)
+		return true
+	}
+	log.Warn("index downgrades packages", "index", file, "downgraded", downgraded)
+	return false
+}
+
+// readRepodata reads the index of the repodata at path and the public key
+// from its index-meta.plist. The key is nil if the repodata is not signed.
+func readRepodata(path string) (index, *repo.PublicKey, error) {
+	rd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer rd.Close()
+	var result struct {
+		Index index          `repodata:"index.plist"`
+		Meta  repo.PublicKey `repodata:"index-meta.plist"`
+	}
+	dec := repodata.NewDecoder(rd)
+	err = dec.Decode(&result)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Meta.Key == nil {
+		return result.Index, nil, nil
+	}
+	return result.Index, &result.Meta, nil
+}
+
+func (data *Stagedata) Update(ctx context.Context) (*indexDiff, error) {
+	file := fmt.Sprintf("%s-stagedata", data.config.Architecture)
+	pattern := fmt.Sprintf(".%s-stagedata.*"+stagedSuffix, data.config.Architecture)
+	var tmpfile string
+	fetchCtx, span := tracer.Start(ctx, "stagedata.fetch")
+	err := data.upstream.Fetch(fetchCtx, data.upstream.Request(file).
+		Header("If-Modified-Since", data.LastModified).
+		Header("If-None-Match", data.ETag).
+		CheckStatus(http.StatusOK).
+		Handle(requests.ChainHandlers(
+			reqextra.CopyCacheHeaders(&data.ETag, &data.LastModified),
+			reqextra.ToTemp(data.config.Destination, pattern, &tmpfile),
+		)))
+	if requests.HasStatusErr(err, http.StatusNotFound, http.StatusNotModified) {
+		endSpan(span, nil)
+	} else {
+		endSpan(span, err)
+	}
+	if err != nil {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		if requests.HasStatusErr(err, http.StatusNotFound) {
+			if data.index == nil {
+				return nil, nil
+			}
+			// 404 for stagedata is different from repodata, we delete the file
+			// and return an empty index.
+			stage(&data.staged, &stagedIndex{name: file})
+			data.index = nil
+			data.key = nil
+			return &indexDiff{}, nil
+		} else if requests.HasStatusErr(err, http.StatusNotModified) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	path := filepath.Join(data.config.Destination, file)
+	index, key, err := readRepodata(tmpfile)
+	if err != nil {
+		data.log.Error("invalid stagedata", "path", path, "error", err)
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				data.log.Error("could not delete invalid stagedata", "path", path, "error", err)
+			}
+		}
+		os.Remove(tmpfile)
+		return nil, err
+	}
+	if err := data.verifier.verify(ctx, file, tmpfile, key); err != nil {
+		os.Remove(tmpfile)
+		index_verification_failures_total.WithLabelValues(data.config.Name).Inc()
+		data.log.Error("rejected stagedata", "error", err)
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	diff := data.index.diff(ctx, "stagedata.diff", index)
+	if checkDowngrades(data.config, data.log, file, &diff) {
+		// the cache headers keep the stagedata from being fetched again
+		// until it changes
+		os.Remove(tmpfile)
+		return nil, nil
+	}
+	countChanges(data.config, file, &diff)
+	data.index = index
+	data.key = key
+	stage(&data.staged, &stagedIndex{name: file, path: tmpfile})
+	return &diff, nil
+}
+
+type Repodata struct {
+	config   *config.RepositoryConfig
+	upstream upstream
+	// staged is the fetched repodata waiting to be published
+	staged   *stagedIndex
+	// verifier checks the signer of fetched repodata, if it is set
+	verifier *verifier
+	// key is the public key the repodata is signed with
+	key      *repo.PublicKey
+	// sum is the sha256 of the last repodata fetched from upstream
+	sum      digest
+	// hold is the sha256 of an upstream repodata that was rolled back,
+	// it is ignored until upstream changes
+	hold     digest
+	// rejected is the sha256 of an upstream repodata that was held back
+	// for downgrading packages, it is ignored until upstream changes
+	rejected digest
+	log    *slog.Logger
+	req    *http.Request
+	index  index
+	ETag string
+	LastModified string
+}
+
+func NewRepodata(config *config.RepositoryConfig, upstream upstream, verifier *verifier, log *slog.Logger) (*Repodata, error) {
+	url := config.Upstream.JoinPath(fmt.Sprintf("%s-repodata", config.Architecture))
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	file := fmt.Sprintf("%s-repodata", config.Architecture)
+	idx, key, err := readRepodata(filepath.Join(config.Destination, file))
+	if err != nil {
+		return nil, err
+	}
+	hold, err := readHold(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Repodata{config: config, upstream: upstream, verifier: verifier, log: log, req: req, index: idx, key: key, hold: hold}, nil
+}
+
+func (data *Repodata) Update(ctx context.Context) (*indexDiff, error) {
+	file := fmt.Sprintf("%s-repodata", data.config.Architecture)
+	pattern := fmt.Sprintf(".%s-repodata.*"+stagedSuffix, data.config.Architecture)
+	var tmpfile string
+	fetchCtx, span := tracer.Start(ctx, "repodata.fetch")
+	err := data.upstream.Fetch(fetchCtx, data.upstream.Request(file).
+		Handle(reqextra.ToTemp(data.config.Destination, pattern, &tmpfile)))
+	endSpan(span, err)
+	if err != nil {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		if requests.HasStatusErr(err, http.StatusNotModified) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sum, err := util.FileSha256(tmpfile)
+	if err != nil {
+		os.Remove(tmpfile)
+		return nil, err
+	}
+	if data.hold != nil {
+		if bytes.Equal(sum, data.hold) {
+			os.Remove(tmpfile)
+			return nil, nil
+		}
+		data.log.Info("upstream repodata changed since the rollback")
+		if err := writeHold(data.config, nil); err != nil {
+			data.log.Error("could not remove rollback hold", "error", err)
+		}
+		data.hold = nil
+	}
+	if bytes.Equal(sum, data.rejected) {
+		os.Remove(tmpfile)
+		return nil, nil
+	}
+	data.rejected = nil
+	path := filepath.Join(data.config.Destination, file)
+	index, key, err := readRepodata(tmpfile)
+	if err != nil {
+		data.log.Error("invalid repodata", "path", path, "error", err)
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				data.log.Error("could not delete invalid repodata", "path", path, "error", err)
+			}
+		}
+		os.Remove(tmpfile)
+		return nil, nil
+	}
+	if err := data.verifier.verify(ctx, file, tmpfile, key); err != nil {
+		os.Remove(tmpfile)
+		index_verification_failures_total.WithLabelValues(data.config.Name).Inc()
+		data.log.Error("rejected repodata", "error", err)
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	diff := data.index.diff(ctx, "repodata.diff", index)
+	if checkDowngrades(data.config, data.log, file, &diff) {
+		os.Remove(tmpfile)
+		data.rejected = sum
+		return nil, nil
+	}
+	countChanges(data.config, file, &diff)
+	data.index = index
+	data.key = key
+	data.sum = sum
+	stage(&data.staged, &stagedIndex{name: file, path: tmpfile, snapshot: true})
+	return &diff, nil
+}
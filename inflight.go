@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+)
+
+// checkFunc accepts or rejects the downloaded file at path.
+type checkFunc func(ctx context.Context, path string) error
+
+// download is a queued or running download shared by all submitters of
+// the same file.
+type download struct {
+	done chan struct{}
+	err  error
+	// checks are the checks of all submitters, they all have to accept
+	// the file before it is stored
+	checks []checkFunc
+	// checking is set once the checks run, the download can no longer
+	// be joined
+	checking bool
+}
+
+func newDownload(check checkFunc) *download {
+	d := &download{done: make(chan struct{})}
+	if check != nil {
+		d.checks = append(d.checks, check)
+	}
+	return d
+}
+
+// Wait blocks until the download finished and returns its error.
+func (d *download) Wait() error {
+	<-d.done
+	return d.err
+}
+
+type inflightKey struct {
+	path   string
+	sha256 string
+}
+
+// inflight tracks queued and running downloads by destination path and
+// checksum, so that a file is only downloaded once even if it is queued
+// from the stagedata and repodata or by repositories sharing a destination.
+type inflight struct {
+	mu        sync.Mutex
+	downloads map[inflightKey]*download
+}
+
+var downloads = &inflight{downloads: make(map[inflightKey]*download)}
+
+// start registers a download for path and sum. If it is already in flight
+// and not checked yet, check is added to it and joined is true.
+func (f *inflight) start(path string, sum digest, check checkFunc) (d *download, joined bool) {
+	key := inflightKey{path: path, sha256: hex.EncodeToString(sum)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.downloads[key]; ok {
+		if !d.checking {
+			if check != nil {
+				d.checks = append(d.checks, check)
+			}
+			return d, true
+		}
+		// too late to check the file for this caller
+		return newDownload(check), false
+	}
+	d = newDownload(check)
+	f.downloads[key] = d
+	return d, false
+}
+
+// check runs the checks of all callers that joined d on the file at path.
+// Callers that start the same download later get a download of their own.
+func (f *inflight) check(ctx context.Context, d *download, path string) error {
+	f.mu.Lock()
+	d.checking = true
+	checks := d.checks
+	f.mu.Unlock()
+	for _, check := range checks {
+		if err := check(ctx, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish removes the download from the registry and wakes up all waiters.
+// It also finishes downloads that were never registered.
+func (f *inflight) finish(path string, sum digest, d *download, err error) {
+	key := inflightKey{path: path, sha256: hex.EncodeToString(sum)}
+	f.mu.Lock()
+	if f.downloads[key] == d {
+		delete(f.downloads, key)
+	}
+	f.mu.Unlock()
+	d.err = err
+	close(d.done)
+}
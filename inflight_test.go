@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInflight(t *testing.T) {
+	errFailed := errors.New("failed")
+	sum := digest{1, 2, 3}
+	tests := []struct {
+		name string
+		// second is the download started after the first one
+		path, secondPath string
+		sum, secondSum   digest
+		// finishFirst finishes the first download before the second
+		// one is started
+		finishFirst bool
+		err         error
+		joined      bool
+	}{
+		{"same file", "/dst/foo", "/dst/foo", sum, sum, false, nil, true},
+		{"same file fails", "/dst/foo", "/dst/foo", sum, sum, false, errFailed, true},
+		{"other checksum", "/dst/foo", "/dst/foo", sum, digest{4}, false, nil, false},
+		{"other path", "/dst/foo", "/other/foo", sum, sum, false, nil, false},
+		{"finished", "/dst/foo", "/dst/foo", sum, sum, true, nil, false},
+		{"no checksum", "/dst/foo", "/dst/foo", nil, nil, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &inflight{downloads: make(map[inflightKey]*download)}
+			first, joined := f.start(tt.path, tt.sum, nil)
+			if joined {
+				t.Fatal("expected the first download to start")
+			}
+			if tt.finishFirst {
+				f.finish(tt.path, tt.sum, first, tt.err)
+			}
+			second, joined := f.start(tt.secondPath, tt.secondSum, nil)
+			if joined != tt.joined {
+				t.Fatalf("joined %v, want %v", joined, tt.joined)
+			}
+			if joined && second != first {
+				t.Fatal("expected the joined download to be the first one")
+			}
+			if !tt.finishFirst {
+				f.finish(tt.path, tt.sum, first, tt.err)
+			}
+			// every waiter of the first download gets its error
+			for i := 0; i < 3; i++ {
+				if err := first.Wait(); err != tt.err {
+					t.Errorf("got error %v, want %v", err, tt.err)
+				}
+			}
+			if !joined {
+				f.finish(tt.secondPath, tt.secondSum, second, nil)
+			}
+			if len(f.downloads) != 0 {
+				t.Errorf("expected no downloads in flight, got %v", f.downloads)
+			}
+		})
+	}
+}
+
+func TestInflightUnregistered(t *testing.T) {
+	f := &inflight{downloads: make(map[inflightKey]*download)}
+	d, _ := f.start("/dst/foo", nil, nil)
+	// finishing a download that was never registered keeps the
+	// registered one
+	other := newDownload(nil)
+	f.finish("/dst/foo", nil, other, nil)
+	if err := other.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if joined, ok := f.start("/dst/foo", nil, nil); !ok || joined != d {
+		t.Error("expected the registered download to stay in flight")
+	}
+	f.finish("/dst/foo", nil, d, nil)
+}
+
+func TestInflightChecks(t *testing.T) {
+	errRejected := errors.New("rejected")
+	f := &inflight{downloads: make(map[inflightKey]*download)}
+	var checked []string
+	check := func(name string, err error) checkFunc {
+		return func(ctx context.Context, path string) error {
+			checked = append(checked, name)
+			return err
+		}
+	}
+	d, _ := f.start("/dst/foo", nil, check("first", nil))
+	// the check of a joining caller runs on the same file
+	if joined, ok := f.start("/dst/foo", nil, check("second", errRejected)); !ok || joined != d {
+		t.Fatal("expected the download to be joined")
+	}
+	if err := f.check(context.Background(), d, "/tmp/foo"); err != errRejected {
+		t.Errorf("got error %v, want %v", err, errRejected)
+	}
+	if len(checked) != 2 || checked[0] != "first" || checked[1] != "second" {
+		t.Errorf("got checks %v", checked)
+	}
+	// a checked download can no longer be joined
+	other, joined := f.start("/dst/foo", nil, nil)
+	if joined || other == d {
+		t.Error("expected a checked download not to be joined")
+	}
+	f.finish("/dst/foo", nil, d, errRejected)
+}
+
+func TestStagedNotJoined(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+
+	rebuilt := testSignedPkg(t, upstream, "foo-1.0_1", "rebuilt foo")
+	writeRepodata(t, repodata, rebuilt)
+	// a download of the rebuilt package that is not staged is running
+	path := filepath.Join(repo.Config.Destination, rebuilt.Filename())
+	d, _ := downloads.start(path, rebuilt.SHA256, nil)
+	defer downloads.finish(path, rebuilt.SHA256, d, nil)
+	syncRepository(t, ctx, repo)
+	if repo.synced != nil {
+		t.Fatal(repo.synced)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "rebuilt foo" {
+		t.Errorf("expected the rebuilt package, got %q", data)
+	}
+}
+
+func TestQueuePanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	repo := testFileRepository(t, ctx, upstream)
+	check := func(ctx context.Context, path string) error { panic("boom") }
+	d := repo.queue(ctx, foo.Filename(), foo.SHA256, foo.Size, check, nil)
+	done := make(chan error)
+	go func() { done <- d.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the panic to fail the download")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download never finished")
+	}
+	// the worker survived and the next download is stored
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	if err := repo.queue(ctx, bar.Filename(), bar.SHA256, bar.Size, nil, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// logFile is a log file that can be reopened after it was rotated.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen closes and reopens the log file.
+func (f *logFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// reopenOnSignal reopens f whenever the process receives SIGUSR1.
+func (f *logFile) reopenOnSignal(ctx context.Context) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+			if err := f.Reopen(); err != nil {
+				slog.Error("could not reopen log file", "path", f.path, "error", err)
+				continue
+			}
+			slog.Info("reopened log file", "path", f.path)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// journaldWriter prefixes every line with the sd-daemon(3) priority of the
+// record that is currently written.
+type journaldWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.prefix); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// journaldHandler writes text records with syslog priority prefixes that
+// journald picks up from the standard output of services.
+type journaldHandler struct {
+	mu *sync.Mutex
+	w  *journaldWriter
+	h  slog.Handler
+}
+
+func newJournaldHandler(w io.Writer, opts *slog.HandlerOptions) *journaldHandler {
+	jw := &journaldWriter{w: w}
+	textOpts := *opts
+	textOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		// journald records the time itself
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return &journaldHandler{
+		mu: &sync.Mutex{},
+		w:  jw,
+		h:  slog.NewTextHandler(jw, &textOpts),
+	}
+}
+
+func journaldPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (h *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.w.prefix = fmt.Sprintf("<%d>", journaldPriority(r.Level))
+	return h.h.Handle(ctx, r)
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journaldHandler{mu: h.mu, w: h.w, h: h.h.WithAttrs(attrs)}
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	return &journaldHandler{mu: h.mu, w: h.w, h: h.h.WithGroup(name)}
+}
+
+func parseLevel(s string) slog.Level {
+	switch s {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// setupLogging sets the default logger as configured. If the logs are
+// written to a file, the file is returned so it can be reopened.
+func setupLogging(conf *config.LoggingConfig) (*logFile, error) {
+	var w io.Writer = os.Stderr
+	var file *logFile
+	if conf.File != "" {
+		var err error
+		file, err = openLogFile(conf.File)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	opts := &slog.HandlerOptions{
+		AddSource: conf.Source,
+		Level:     parseLevel(conf.Level),
+	}
+	var handler slog.Handler
+	switch conf.Format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "journald":
+		handler = newJournaldHandler(w, opts)
+	default:
+		handler = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return file, nil
+}
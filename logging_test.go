@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+func TestJournaldHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(newJournaldHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	log.Error("failed", "error", "boom")
+	log.With("repository", "current/x86_64").Warn("slow")
+	log.Info("done")
+	log.Debug("details")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		`<3>level=ERROR msg=failed error=boom`,
+		`<4>level=WARN msg=slow repository=current/x86_64`,
+		`<6>level=INFO msg=done`,
+		`<7>level=DEBUG msg=details`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("got %q, want %q", lines[i], want[i])
+		}
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	path := filepath.Join(t.TempDir(), "void-mirror.log")
+	file, err := setupLogging(&config.LoggingConfig{Format: "json", Level: "warn", File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.file.Close()
+	slog.Info("dropped")
+	slog.Warn("kept", "repository", "current/x86_64")
+	// the log file is reopened after it was rotated
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	slog.Error("rotated")
+
+	var record struct {
+		Level      string `json:"level"`
+		Msg        string `json:"msg"`
+		Repository string `json:"repository"`
+	}
+	data, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", data, err)
+	}
+	if record.Level != "WARN" || record.Msg != "kept" || record.Repository != "current/x86_64" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil || record.Msg != "rotated" {
+		t.Errorf("expected the record in the new file, got %q", data)
+	}
+}
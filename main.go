@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
+	"runtime/debug"
 	"time"
 
 	"golang.org/x/exp/slog"
@@ -15,17 +15,13 @@ import (
 
 	"github.com/hashicorp/hcl/v2"
 
-	"github.com/gammazero/workerpool"
-
-	"github.com/carlmjohnson/requests"
-
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"github.com/Duncaen/go-xbps/repo/repodata"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/void-linux/void-mirror/config"
-	"github.com/void-linux/void-mirror/reqextra"
 )
 
 var (
@@ -50,24 +46,131 @@ var (
 		},
 		[]string{"code"},
 	)
-	queue_running = prometheus.NewGauge(
+	queue_running = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "queue_running",
-			Help:      "Number of queue jobs currently running",
+			Help:      "Number of queue jobs currently running by host",
 		},
+		[]string{"host"},
 	)
-	queue_workers = prometheus.NewGauge(
+	queue_workers = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "queue_workers",
-			Help:      "Number of workers",
+			Help:      "Number of workers by host",
+		},
+		[]string{"host"},
+	)
+	download_timeouts_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "download_timeouts_total",
+			Help:      "Number of timed out requests by host and timeout",
+		},
+		[]string{"host", "timeout"},
+	)
+	webhook_requests_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_requests_total",
+			Help:      "Number of webhook requests by result",
+		},
+		[]string{"result"},
+	)
+	hook_runs_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hook_runs_total",
+			Help:      "Number of hook runs by hook and result",
+		},
+		[]string{"hook", "result"},
+	)
+	update_errors_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "update_errors_total",
+			Help:      "Number of failed repository updates by repository",
+		},
+		[]string{"repository"},
+	)
+	index_verification_failures_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "index_verification_failures_total",
+			Help:      "Number of fetched indexes that failed signature verification",
+		},
+		[]string{"repository"},
+	)
+	quarantined_files_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "quarantined_files_total",
+			Help:      "Number of downloads moved to quarantine by reason",
+		},
+		[]string{"repository", "reason"},
+	)
+	package_changes_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "package_changes_total",
+			Help:      "Number of changed packages by repository, index and change",
+		},
+		[]string{"repository", "index", "change"},
+	)
+	index_updates_held_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "index_updates_held_total",
+			Help:      "Number of fetched indexes held back for downgrading packages",
+		},
+		[]string{"repository", "index"},
+	)
+	signature_verification_failures_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signature_verification_failures_total",
+			Help:      "Number of package signatures that failed verification",
+		},
+		[]string{"repository"},
+	)
+	repository_degraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "repository_degraded",
+			Help:      "Whether the last update of the repository failed",
+		},
+		[]string{"repository"},
+	)
+	seeded_packages_total = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "seeded_packages_total",
+			Help:      "Number of packages transferred with rsync by repository",
+		},
+		[]string{"repository"},
+	)
+	queue_deduplicated_total = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queue_deduplicated_total",
+			Help:      "Number of downloads that joined an already queued download",
+		},
+	)
+	tempfiles_removed_total = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tempfiles_removed_total",
+			Help:      "Number of stale temporary files removed",
+		},
+	)
+	tempfiles_removed_bytes_total = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tempfiles_removed_bytes_total",
+			Help:      "Bytes of stale temporary files removed (total)",
 		},
 	)
-)
-
-var (
-	transport = requests.LogTransport(http.DefaultClient.Transport, requestLogger)
 )
 
 func requestLogger(req *http.Request, res *http.Response, err error, d time.Duration) {
@@ -84,7 +187,10 @@ func requestLogger(req *http.Request, res *http.Response, err error, d time.Dura
 		"error", err,
 	)
 	responses_total.WithLabelValues(fmt.Sprintf("%d", res.StatusCode)).Add(1)
-	download_bytes_total.Add(float64(res.ContentLength))
+	// the length is unknown (-1) for chunked and file:// responses
+	if res.ContentLength > 0 {
+		download_bytes_total.Add(float64(res.ContentLength))
+	}
 }
 
 func updateRequestConditions(req *http.Request, resp *http.Response) {
@@ -100,327 +206,141 @@ func updateRequestConditions(req *http.Request, resp *http.Response) {
 	}
 }
 
-type Stagedata struct {
-	config *config.RepositoryConfig
-	req    *http.Request
-	index  index
-	ETag string
-	LastModified string
-}
-
-func NewStagedata(config *config.RepositoryConfig) (*Stagedata, error) {
-	url := config.Upstream.JoinPath(fmt.Sprintf("%s-stagedata", config.Architecture))
-	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	file := fmt.Sprintf("%s-stagedata", config.Architecture)
-	idx, err := readRepodata(filepath.Join(config.Destination, file))
-	if err != nil {
-		return nil, err
-	}
-	return &Stagedata{config: config, req: req, index: idx}, nil
-}
-
-type digest []byte
-
-func (h *digest) UnmarshalPlist(unmarshal func(interface{}) error) error {
-	var s string
-	if err := unmarshal(&s); err != nil {
-		return err
-	}
-	data, err := hex.DecodeString(s)
-	if err != nil {
-		return fmt.Errorf("could not decode digest: %v", err)
-	}
-	*h = data
-	return nil
-}
-
-// pkg is a package from {repo,stage}data with the metadata fields we care for.
-type pkg struct {
-	Pkgver string `plist:"pkgver"`
-	Arch   string `plist:"architecture"`
-	SHA256 digest `plist:"filename-sha256"`
-}
-
-func (pkg pkg) Filename() string {
-	return fmt.Sprintf("%s.%s.xbps", pkg.Pkgver, pkg.Arch)
-}
-
-// index is the repository index
-type index map[string]*pkg
-
-type indexDiff struct {
-	Added   []*pkg
-	Deleted []*pkg
+type Repository struct {
+	Config    *config.RepositoryConfig
+	host      *host
+	upstream  upstream
+	storage   storage
+	Repodata  *Repodata
+	Stagedata *Stagedata
+	trigger   chan struct{}
+	status    status
+	log       *slog.Logger
+	// pending are the downloads queued since the last update finished
+	pending   []pendingDownload
+	// missing are indexed packages that are not stored yet
+	missing   []*pkg
+	// published is closed once the last update is published
+	published chan struct{}
+	// deferred are the staged files waiting for failed downloads
+	deferred  deferredFiles
+	// synced is the error of the last published update
+	synced    error
+	snapshots snapshots
+	rollbacks chan *rollbackRequest
+	// archive is only set in archive mode
+	archive   *archiveLog
+	changes   *changeLog
+	req       *http.Request
+	files     map[string]struct{}
+	obsolete  map[string]time.Time
+	ctx       context.Context
 }
 
-func (idx index) Diff(other index) indexDiff {
-	var d indexDiff
-	for name, newpkg := range other {
-		oldpkg, ok := idx[name]
-		if !ok {
-			d.Added = append(d.Added, newpkg)
-		} else if newpkg.Pkgver != oldpkg.Pkgver {
-			d.Added = append(d.Added, newpkg)
-			d.Deleted = append(d.Deleted, oldpkg)
-		}
-	}
-	for name, pkg := range idx {
-		if _, ok := other[name]; !ok {
-			d.Deleted = append(d.Deleted, pkg)
-		}
+func NewRepository(ctx context.Context, config *config.RepositoryConfig, host *host, upstream upstream, storage storage) (*Repository, error) {
+	r := &Repository{
+		Config: config,
+		host:      host,
+		upstream:  upstream,
+		storage:   storage,
+		trigger:   make(chan struct{}, 1),
+		rollbacks: make(chan *rollbackRequest),
+		log:       slog.With("repository", config.Name, "arch", config.Architecture),
+		ctx:       ctx,
 	}
-	return d
-}
-
-func readRepodata(path string) (index, error) {
-	rd, err := os.Open(path)
+	r.status.started = time.Now()
+	host.sched.SetWeight(config.Name, config.Priority)
+	verifier, err := newVerifier(config, upstream)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	defer rd.Close()
-	var result struct {
-		Index index `repodata:"index.plist"`
+	if verifier != nil && !config.IndexSignature {
+		r.log.Warn("trusted_keys without index_signature only pin the index key, indexes are not verified cryptographically")
 	}
-	dec := repodata.NewDecoder(rd)
-	err = dec.Decode(&result)
+	r.Repodata, err = NewRepodata(config, upstream, verifier, r.log)
 	if err != nil {
 		return nil, err
 	}
-	return result.Index, nil
-}
-
-func (data *Stagedata) Update(ctx context.Context) (*indexDiff, error) {
-	file := fmt.Sprintf("%s-stagedata", data.config.Architecture)
-	pattern := fmt.Sprintf(".%s-stagedata.*", data.config.Architecture)
-	url := data.config.Upstream.JoinPath(file)
-	var tmpfile string
-	err := requests.URL(url.String()).
-		Transport(transport).
-		Header("If-Modified-Since", data.LastModified).
-		Header("If-None-Match", data.ETag).
-		CheckStatus(http.StatusOK).
-		Handle(requests.ChainHandlers(
-			reqextra.CopyCacheHeaders(&data.ETag, &data.LastModified),
-			reqextra.ToTemp(data.config.Destination, pattern, &tmpfile),
-		)).Fetch(ctx)
+	r.Stagedata, err = NewStagedata(config, upstream, verifier, r.log)
 	if err != nil {
-		if tmpfile != "" {
-			os.Remove(tmpfile)
-		}
-		if requests.HasStatusErr(err, http.StatusNotFound) {
-			if data.index == nil {
-				return nil, nil
-			}
-			// 404 for stagedata is different from repodata, we delete the file
-			// and return an empty index.
-			if err := os.Remove(filepath.Join(data.config.Destination, file)); err != nil {
-				if !os.IsNotExist(err) {
-					return nil, err
-				}
-			}
-			data.index = nil
-			return &indexDiff{}, nil
-		} else if requests.HasStatusErr(err, http.StatusNotModified) {
-			return nil, nil
-		}
 		return nil, err
 	}
-
-	path := filepath.Join(data.config.Destination, file)
-	index, err := readRepodata(tmpfile)
+	r.req, err = http.NewRequest(http.MethodGet, config.Upstream.String(), nil)
 	if err != nil {
-		slog.Error("invalid stagedata", "path", path, "error", err)
-		if err := os.Remove(path); err != nil {
-			if !os.IsNotExist(err) {
-				slog.Error("could not delete invalid stagedata", "path", path, "error", err)
-			}
-		}
-		os.Remove(tmpfile)
 		return nil, err
 	}
-	diff := data.index.Diff(index)
-	data.index = index
-	if err := os.Rename(tmpfile, path); err != nil {
-		return &diff, err
-	}
-	return &diff, nil
-}
-
-type Repodata struct {
-	config *config.RepositoryConfig
-	req    *http.Request
-	index  index
-	ETag string
-	LastModified string
-}
-
-func NewRepodata(config *config.RepositoryConfig) (*Repodata, error) {
-	url := config.Upstream.JoinPath(fmt.Sprintf("%s-repodata", config.Architecture))
-	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
-	if err != nil {
+	if err := os.MkdirAll(config.Destination, 0755); err != nil {
 		return nil, err
 	}
-	file := fmt.Sprintf("%s-repodata", config.Architecture)
-	idx, err := readRepodata(filepath.Join(config.Destination, file))
+	r.obsolete, err = readObsolete(config)
 	if err != nil {
 		return nil, err
 	}
-	return &Repodata{config: config, req: req, index: idx}, nil
-}
-
-func (data *Repodata) Update(ctx context.Context) (*indexDiff, error) {
-	file := fmt.Sprintf("%s-repodata", data.config.Architecture)
-	pattern := fmt.Sprintf(".%s-repodata.*", data.config.Architecture)
-	url := data.config.Upstream.JoinPath(file)
-	var tmpfile string
-	err := requests.URL(url.String()).
-		Transport(transport).
-		Handle(reqextra.ToTemp(data.config.Destination, pattern, &tmpfile)).
-		Fetch(ctx)
-	if err != nil {
-		if tmpfile != "" {
-			os.Remove(tmpfile)
-		}
-		if requests.HasStatusErr(err, http.StatusNotModified) {
-			return nil, nil
-		}
+	if err := r.loadSnapshots(); err != nil {
 		return nil, err
 	}
-	path := filepath.Join(data.config.Destination, file)
-	index, err := readRepodata(tmpfile)
-	if err != nil {
-		slog.Error("invalid repodata", "path", path, "error", err)
-		if err := os.Remove(path); err != nil {
-			if !os.IsNotExist(err) {
-				slog.Error("could not delete invalid repodata", "path", path, "error", err)
-			}
-		}
-		return nil, nil
-	}
-	diff := data.index.Diff(index)
-	data.index = index
-	if err := os.Rename(tmpfile, path); err != nil {
-		return &diff, err
-	}
-	return &diff, nil
-}
-
-type Repository struct {
-	Config    *config.RepositoryConfig
-	Repodata  *Repodata
-	Stagedata *Stagedata
-	ticker    *time.Ticker
-	req       *http.Request
-	files     map[string]struct{}
-	obsolete  map[string]time.Time
-	ctx       context.Context
-}
-
-func (r *Repository) queue(req *requests.Builder) {
-	wp.Submit(func() {
-		queue_running.Inc()
-		defer queue_running.Dec()
-		url, err := req.URL()
-		if err != nil {
-			slog.Error("url error", "error", err)
-			return
-		}
-		slog.Info("downloading", "url", url)
-		err = req.Fetch(r.ctx)
-		if err != nil {
-			slog.Error("donwloading", "error", err)
-		}
-	})
-}
-
-func (r *Repository) queuePkg(pkg *pkg) error {
-	binpkg := pkg.Filename()
-	url := r.Config.Upstream.JoinPath(binpkg)
-	path := filepath.Join(r.Config.Destination, binpkg)
-	r.queue(requests.URL(url.String()).
-		Transport(transport).
-		Handle(reqextra.Sha256Verify(pkg.SHA256, reqextra.ToFileAtomic(path))))
-	return nil
-}
-
-func (r *Repository) queueSig(pkg *pkg) error {
-	sigfile := pkg.Filename() + ".sig"
-	path := filepath.Join(r.Config.Destination, sigfile)
-	url := r.Config.Upstream.JoinPath(sigfile)
-	r.queue(requests.
-		URL(url.String()).
-		Handle(reqextra.ToFileAtomic(path)))
-	return nil
-}
-
-func NewRepository(ctx context.Context, config *config.RepositoryConfig) (*Repository, error) {
-	r := &Repository{
-		Config: config,
-		files:     make(map[string]struct{}),
-		obsolete:  make(map[string]time.Time),
-		ctx:       ctx,
-	}
-	var err error
-	r.Repodata, err = NewRepodata(config)
+	r.archive, err = openArchive(config, r.Repodata.index)
 	if err != nil {
 		return nil, err
 	}
-	r.Stagedata, err = NewStagedata(config)
+	r.changes, err = openChangeLog(config)
 	if err != nil {
 		return nil, err
 	}
-	r.req, err = http.NewRequest(http.MethodGet, config.Upstream.String(), nil)
+	r.files, err = r.storage.List(ctx)
 	if err != nil {
 		return nil, err
 	}
-	r.ticker = time.NewTicker(*config.Interval)
-	if err := os.MkdirAll(config.Destination, 0755); err != nil {
-		return nil, err
-	}
 	for _, pkg := range r.Repodata.index {
 		binpkg := pkg.Filename()
-		if _, err := os.Stat(filepath.Join(config.Destination, binpkg)); err != nil {
-			if !os.IsNotExist(err) {
-				return nil, err
-			}
-			if err := r.queuePkg(pkg); err != nil {
-				return nil, err
-			}
+		if _, ok := r.files[binpkg]; !ok {
+			r.missing = append(r.missing, pkg)
 		}
-		sigfile := binpkg + ".sig"
-		if _, err := os.Stat(filepath.Join(config.Destination, sigfile)); err != nil {
-			if !os.IsNotExist(err) {
-				return nil, err
-			}
-			if err := r.queueSig(pkg); err != nil {
+		if _, ok := r.files[binpkg+".sig"]; !ok {
+			if err := r.queueSig(ctx, pkg, nil); err != nil {
 				return nil, err
 			}
 		}
-		r.files[binpkg] = struct{}{}
-		r.files[sigfile] = struct{}{}
 	}
 	return r, nil
 }
 
-func (r *Repository) update(ctx context.Context) error {
+func (r *Repository) update(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "update", trace.WithAttributes(
+		attribute.String("repository", r.Config.Name),
+		attribute.String("arch", r.Config.Architecture),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+	index, key, sum := r.Repodata.index, r.Repodata.key, r.Repodata.sum
 	repoDiff, err := r.Repodata.Update(ctx)
 	if err != nil {
 		return err
 	}
 	stageDiff, err := r.Stagedata.Update(ctx)
 	if err != nil {
+		if repoDiff != nil {
+			// the next update fetches the repodata again
+			stage(&r.Repodata.staged, nil)
+			r.Repodata.index, r.Repodata.key, r.Repodata.sum = index, key, sum
+		}
 		return err
 	}
-	if stageDiff != nil {
-		for _, added := range stageDiff.Added {
-			r.queuePkg(added)
+	r.recordDiff("repodata", repoDiff)
+	r.recordDiff("stagedata", stageDiff)
+	// the stagedata is published before the repodata
+	var staged []*stagedIndex
+	for _, dst := range []**stagedIndex{&r.Stagedata.staged, &r.Repodata.staged} {
+		if *dst != nil {
+			staged = append(staged, *dst)
+			*dst = nil
 		}
+	}
+	fetch := r.missing
+	r.missing = nil
+	if stageDiff != nil {
+		fetch = append(fetch, stageDiff.Added...)
 		now := time.Now()
 		for _, deleted := range stageDiff.Deleted {
 			filename := deleted.Filename()
@@ -430,7 +350,7 @@ func (r *Repository) update(ctx context.Context) error {
 	}
 	if repoDiff != nil {
 		for _, added := range repoDiff.Added {
-			r.queuePkg(added)
+			fetch = append(fetch, added)
 			binpkg := added.Filename()
 			// packages may be removed from stage and marked as obsolete, undo that
 			delete(r.obsolete, binpkg)
@@ -443,27 +363,166 @@ func (r *Repository) update(ctx context.Context) error {
 			r.obsolete[binpkg+".sig"] = now
 		}
 	}
+	r.fetchPkgs(ctx, fetch)
+	for _, p := range r.deferred.retry() {
+		if !r.hasPkg(p.pkg) {
+			continue
+		}
+		if p.sig {
+			r.queueSig(ctx, p.pkg, nil)
+		} else {
+			r.queuePkg(ctx, p.pkg, nil)
+		}
+	}
+	// failed rebuilt packages are retried while they are indexed
+	var rebuilt []*stagedIndex
+	for _, pkg := range r.deferred.failed() {
+		if r.hasPkg(pkg) {
+			rebuilt = append(rebuilt, r.refetch(ctx, pkg)...)
+		} else {
+			r.deferred.drop(pkg)
+		}
+	}
+	for _, diff := range []*indexDiff{stageDiff, repoDiff} {
+		if diff == nil {
+			continue
+		}
+		for _, u := range diff.Rebuilt {
+			rebuilt = append(rebuilt, r.refetch(ctx, u.New)...)
+		}
+	}
+	staged = append(rebuilt, staged...)
+	if stageDiff != nil || repoDiff != nil {
+		r.saveObsolete()
+	}
+	changed := r.emitChanges(stageDiff, repoDiff)
+	if pending := r.pending; changed || len(pending) > 0 || len(staged) > 0 {
+		r.pending = nil
+		prev := r.published
+		r.published = make(chan struct{})
+		go r.waitSync(prev, r.published, pending, staged, changed || len(pending) > 0)
+	}
+	if r.Config.ObsoleteMaxAge > 0 {
+		r.gc(ctx, time.Now())
+	}
 	return nil
 }
 
-func (r *Repository) Run(ctx context.Context) error {
-	if err := r.update(ctx); err != nil {
-		return err
+// hasPkg reports whether pkg is in the repodata or stagedata.
+func (r *Repository) hasPkg(pkg *pkg) bool {
+	name, _ := splitPkgver(pkg.Pkgver)
+	for _, idx := range []index{r.Repodata.index, r.Stagedata.index} {
+		if p := idx[name]; p != nil && p.Pkgver == pkg.Pkgver && bytes.Equal(p.SHA256, pkg.SHA256) {
+			return true
+		}
 	}
+	return false
+}
+
+// emitChanges emits a packages event and reports whether anything changed.
+func (r *Repository) emitChanges(diffs ...*indexDiff) bool {
+	ev := newEvent(config.EventPackages, r.Config)
+	for _, diff := range diffs {
+		if diff == nil {
+			continue
+		}
+		for _, pkg := range diff.Added {
+			ev.Added = append(ev.Added, pkg.Pkgver)
+		}
+		for _, pkg := range diff.Deleted {
+			ev.Deleted = append(ev.Deleted, pkg.Pkgver)
+		}
+		for _, u := range diff.Rebuilt {
+			ev.Rebuilt = append(ev.Rebuilt, u.New.Pkgver)
+		}
+	}
+	if len(ev.Added) == 0 && len(ev.Deleted) == 0 && len(ev.Rebuilt) == 0 {
+		return false
+	}
+	emit(ev)
+	return true
+}
+
+// runUpdate runs update and records its result.
+func (r *Repository) runUpdate(ctx context.Context) (err error) {
+	defer func() {
+		// a malformed index must not take down the other repositories
+		if v := recover(); v != nil {
+			r.log.Error("update panicked", "panic", v, "stack", string(debug.Stack()))
+			err = fmt.Errorf("update panicked: %v", v)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.status.updated(err)
+		if err != nil {
+			update_errors_total.WithLabelValues(r.Config.Name).Inc()
+			repository_degraded.WithLabelValues(r.Config.Name).Set(1)
+			ev := newEvent(config.EventError, r.Config)
+			ev.Error = err.Error()
+			emit(ev)
+		} else {
+			repository_degraded.WithLabelValues(r.Config.Name).Set(0)
+		}
+	}()
+	return r.update(ctx)
+}
+
+// Trigger requests an immediate update, pending triggers are coalesced.
+func (r *Repository) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run updates the repository until ctx is canceled, retrying failed
+// updates with a backoff.
+func (r *Repository) Run(ctx context.Context) error {
+	failures := 0
 	for {
-		select {
-		case _ = <-r.ticker.C:
-			if err := r.update(ctx); err != nil {
-				return err
+		var wait time.Duration
+		if err := r.runUpdate(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			failures++
+			wait = backoff(failures)
+			r.log.Error("update failed",
+				"error", err,
+				"failures", failures,
+				"retry", wait,
+			)
+		} else {
+			failures = 0
+		}
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if failures > 0 {
+			timer = time.NewTimer(wait)
+			tick = timer.C
+		} else if next := nextUpdate(r.Config, time.Now()); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			tick = timer.C
+		}
+		select {
+		case <-tick:
+		case <-r.trigger:
+			r.log.Info("update triggered")
+		case req := <-r.rollbacks:
+			req.done <- r.rollback(ctx, req.date)
 		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
 			return ctx.Err()
 		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
 
-var wp *workerpool.WorkerPool
-
 type collector struct {
 	queueWaiting *prometheus.Desc
 }
@@ -473,16 +532,17 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (c *collector) Collect(ch chan<- prometheus.Metric) {
-	ch <- prometheus.MustNewConstMetric(c.queueWaiting, prometheus.GaugeValue, float64(wp.WaitingQueueSize()))
+	for name, host := range hosts {
+		ch <- prometheus.MustNewConstMetric(c.queueWaiting, prometheus.GaugeValue, float64(host.sched.WaitingQueueSize()), name)
+	}
 }
 
 func main() {
 	flag.Parse()
 	opts := &slog.HandlerOptions{
-		AddSource: true,
-		Level: slog.LevelDebug,
+		Level: slog.LevelInfo,
 	}
-	textHandler := slog.NewTextHandler(os.Stdout, opts)
+	textHandler := slog.NewTextHandler(os.Stderr, opts)
 	slog.SetDefault(slog.New(textHandler))
 
 	var conf config.Config
@@ -500,27 +560,93 @@ func main() {
 	if diags.HasErrors() {
 		os.Exit(1)
 	}
-	wp = workerpool.New(conf.Jobs)
-	queue_workers.Set(float64(conf.Jobs))
+	switch cmd := flag.Arg(0); cmd {
+	case "", "plan", "sync":
+	default:
+		slog.Error("unknown command", "command", cmd)
+		os.Exit(2)
+	}
+	logfile, err := setupLogging(&conf.Logging)
+	if err != nil {
+		slog.Error("could not open log file", "path", conf.Logging.File, "error", err)
+		os.Exit(1)
+	}
+	if flag.Arg(0) == "plan" {
+		os.Exit(runPlan(&conf, flag.Args()[1:]))
+	}
+	shutdown := func(context.Context) error { return nil }
+	if conf.Tracing != nil {
+		shutdown, err = setupTracing(context.Background(), conf.Tracing)
+		if err != nil {
+			slog.Error("could not set up tracing", "error", err)
+			os.Exit(1)
+		}
+	}
+	defer shutdown(context.Background())
+
+	rsyncPath = conf.RsyncPath
+
+	for _, hookconf := range conf.Hooks {
+		hooks = append(hooks, newHook(hookconf))
+	}
+
+	if flag.Arg(0) == "sync" {
+		status := runSync(&conf, flag.Args()[1:])
+		shutdown(context.Background())
+		os.Exit(status)
+	}
+
+	sw := newSweeper(&conf)
+	sw.sweep()
 
 	repos := []*Repository{}
 	g, ctx := errgroup.WithContext(context.Background())
-	for _, conf := range conf.Repositories {
-		repo, err := NewRepository(ctx, conf)
+	g.Go(func() error {
+		return sw.Run(ctx)
+	})
+	if logfile != nil {
+		g.Go(func() error {
+			return logfile.reopenOnSignal(ctx)
+		})
+	}
+	for _, h := range hooks {
+		h := h
+		g.Go(func() error {
+			return h.Run(ctx)
+		})
+	}
+	if err := removeStaged(conf.Repositories); err != nil {
+		slog.Error("removing staged files failed", "error", err)
+		os.Exit(1)
+	}
+	for _, repoconf := range conf.Repositories {
+		host, err := getHost(&conf, upstreamHost(repoconf.Upstream))
+		if err != nil {
+			slog.Error("initializing host failed", "error", err)
+			os.Exit(1)
+		}
+		store, err := newStorage(&conf, repoconf)
+		if err != nil {
+			slog.Error("initializing storage failed", "error", err)
+			os.Exit(1)
+		}
+		repo, err := NewRepository(ctx, repoconf, host, newUpstream(repoconf.Upstream, host), store)
 		if err != nil {
 			slog.Error("initializing repository failed", "error", err)
 			os.Exit(1)
 		}
 		g.Go(func() error {
-			return repo.Run(ctx)
+			err := repo.Run(ctx)
+			repo.status.exit(err)
+			return err
 		})
 		repos = append(repos, repo)
 	}
 	prometheus.MustRegister(&collector{
 		queueWaiting: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "queue_waiting"),
-			"Queue waiting size",
-			nil,
+			"Queue waiting size by host",
+			[]string{"host"},
 			nil,
 		),
 	})
@@ -528,15 +654,46 @@ func main() {
 	prometheus.MustRegister(responses_total)
 	prometheus.MustRegister(queue_running)
 	prometheus.MustRegister(queue_workers)
+	prometheus.MustRegister(queue_deduplicated_total)
+	prometheus.MustRegister(download_timeouts_total)
+	prometheus.MustRegister(webhook_requests_total)
+	prometheus.MustRegister(hook_runs_total)
+	prometheus.MustRegister(update_errors_total)
+	prometheus.MustRegister(seeded_packages_total)
+	prometheus.MustRegister(repository_degraded)
+	prometheus.MustRegister(index_verification_failures_total)
+	prometheus.MustRegister(signature_verification_failures_total)
+	prometheus.MustRegister(quarantined_files_total)
+	prometheus.MustRegister(package_changes_total)
+	prometheus.MustRegister(index_updates_held_total)
+	prometheus.MustRegister(tempfiles_removed_total)
+	prometheus.MustRegister(tempfiles_removed_bytes_total)
 
 	http.Handle("/metrics", promhttp.Handler())
+	hc := &healthChecker{conf: &conf.Health, repos: repos}
+	http.HandleFunc("/healthz", hc.healthz)
+	http.HandleFunc("/readyz", hc.readyz)
+	http.Handle("/snapshots/", &snapshotHandler{repos: repos})
+	http.Handle("/archive", &archiveHandler{repos: repos})
+	http.Handle("/changes/", &changesHandler{repos: repos})
+	if conf.Webhook != nil {
+		http.Handle(conf.Webhook.Path, newWebhook(conf.Webhook, repos))
+	}
+	if conf.Webhook != nil && conf.Webhook.Token != "" {
+		http.Handle("/quarantine", &adminHandler{token: conf.Webhook.Token, h: &quarantineHandler{repos: repos}})
+		http.Handle("/rollback", &adminHandler{token: conf.Webhook.Token, h: &rollbackHandler{repos: repos}})
+	} else {
+		slog.Warn("admin endpoints disabled, they require a webhook token")
+	}
 	g.Go(func() error {
 		return http.ListenAndServe(*listenaddr, nil)
 	})
 
-	err := g.Wait()
+	err = g.Wait()
 	if err != nil {
 		slog.Error("something went wrong", "error", err)
 	}
-	wp.Stop()
+	for _, host := range hosts {
+		host.sched.Stop()
+	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// obsoleteDir is the directory in the destination that records since when
+// files are obsolete, so that they are deleted after ObsoleteMaxAge even
+// if the mirror is restarted or only runs one-shot syncs.
+const obsoleteDir = ".obsolete"
+
+func obsoletePath(conf *config.RepositoryConfig) string {
+	return filepath.Join(conf.Destination, obsoleteDir, fmt.Sprintf("%s.json", conf.Architecture))
+}
+
+func readObsolete(conf *config.RepositoryConfig) (map[string]time.Time, error) {
+	obsolete := make(map[string]time.Time)
+	data, err := os.ReadFile(obsoletePath(conf))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return obsolete, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &obsolete); err != nil {
+		return nil, fmt.Errorf("%s: %w", obsoletePath(conf), err)
+	}
+	return obsolete, nil
+}
+
+// writeObsolete replaces the record of the obsolete files of conf.
+func writeObsolete(conf *config.RepositoryConfig, obsolete map[string]time.Time) error {
+	path := obsoletePath(conf)
+	data, err := json.Marshal(obsolete)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// saveObsolete records the obsolete files of the repository.
+func (r *Repository) saveObsolete() {
+	if err := writeObsolete(r.Config, r.obsolete); err != nil {
+		r.log.Error("could not record obsolete files", "path", obsoletePath(r.Config), "error", err)
+	}
+}
+
+// gc deletes packages that were removed from the index more than
+// ObsoleteMaxAge ago, unless a snapshot references them.
+func (r *Repository) gc(ctx context.Context, now time.Time) {
+	snapshotted := r.snapshots.files()
+	deleted := false
+	for name, since := range r.obsolete {
+		if now.Sub(since) < r.Config.ObsoleteMaxAge {
+			continue
+		}
+		if _, ok := snapshotted[name]; ok {
+			continue
+		}
+		if err := r.storage.Delete(ctx, name); err != nil {
+			r.log.Error("could not delete obsolete file", "name", name, "error", err)
+			continue
+		}
+		r.log.Info("deleted obsolete file", "name", name)
+		delete(r.obsolete, name)
+		delete(r.files, name)
+		deleted = true
+	}
+	if deleted {
+		r.saveObsolete()
+	}
+}
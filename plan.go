@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/Duncaen/go-xbps/util"
+
+	"github.com/void-linux/void-mirror/config"
+	"github.com/void-linux/void-mirror/reqextra"
+)
+
+// planFile is a file that an update would download or delete.
+type planFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// plan is what an update of a repository would change in its
+// destination.
+type plan struct {
+	Repository    string     `json:"repository"`
+	Download      []planFile `json:"download"`
+	DownloadBytes int64      `json:"download_bytes"`
+	Delete        []planFile `json:"delete"`
+	DeleteBytes   int64      `json:"delete_bytes"`
+	// Held are the indexes that would not be updated because they
+	// downgrade packages or were rolled back.
+	Held  []string `json:"held,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// fetchIndex fetches the named index from up into a temporary file
+// outside of the destination and returns its index and sha256. It returns
+// a nil index if upstream does not have the file.
+func fetchIndex(ctx context.Context, up upstream, name string) (index, digest, error) {
+	var tmpfile string
+	err := up.Fetch(ctx, up.Request(name).
+		CheckStatus(http.StatusOK).
+		Handle(reqextra.ToTemp("", "void-mirror-plan-*", &tmpfile)))
+	if tmpfile != "" {
+		defer os.Remove(tmpfile)
+	}
+	if requests.HasStatusErr(err, http.StatusNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	idx, _, err := readRepodata(tmpfile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	sum, err := util.FileSha256(tmpfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx, sum, nil
+}
+
+// planRepository compares the indexes of the upstream of conf with the
+// indexes and files in its destination without changing either.
+func planRepository(ctx context.Context, conf *config.RepositoryConfig, up upstream, store storage) (*plan, error) {
+	p := &plan{Repository: conf.Name, Download: []planFile{}, Delete: []planFile{}}
+	stored, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := readHold(conf)
+	if err != nil {
+		return nil, err
+	}
+	download := make(map[string]*pkg)
+	deleted := make(map[string]*pkg)
+	referenced := make(map[string]struct{})
+	for _, suffix := range []string{"stagedata", "repodata"} {
+		file := fmt.Sprintf("%s-%s", conf.Architecture, suffix)
+		local, _, err := readRepodata(filepath.Join(conf.Destination, file))
+		if err != nil {
+			return nil, err
+		}
+		remote, sum, err := fetchIndex(ctx, up, file)
+		if err != nil {
+			return nil, err
+		}
+		if remote == nil && suffix == "repodata" {
+			return nil, fmt.Errorf("%s: not found upstream", file)
+		}
+		diff := local.Diff(remote)
+		if suffix == "repodata" && hold != nil && bytes.Equal(sum, hold) ||
+			conf.Downgrades == config.DowngradeHold && len(diff.Downgraded) > 0 {
+			p.Held = append(p.Held, file)
+			remote, diff = local, indexDiff{}
+		}
+		for _, pkg := range remote {
+			referenced[pkg.Filename()] = struct{}{}
+			if _, ok := stored[pkg.Filename()]; !ok {
+				download[pkg.Filename()] = pkg
+			}
+		}
+		for _, u := range diff.Rebuilt {
+			download[u.New.Filename()] = u.New
+		}
+		if conf.ObsoleteMaxAge > 0 {
+			for _, pkg := range diff.Deleted {
+				deleted[pkg.Filename()] = pkg
+			}
+		}
+	}
+	for name, pkg := range download {
+		p.Download = append(p.Download, planFile{Name: name, Size: pkg.Size})
+		p.DownloadBytes += pkg.Size
+	}
+	for name, pkg := range deleted {
+		// still referenced by the other index
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		if _, ok := stored[name]; !ok {
+			continue
+		}
+		p.Delete = append(p.Delete, planFile{Name: name, Size: pkg.Size})
+		p.DeleteBytes += pkg.Size
+	}
+	for _, files := range [][]planFile{p.Download, p.Delete} {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
+	return p, nil
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (p *plan) writeText(w io.Writer) {
+	if p.Error != "" {
+		fmt.Fprintf(w, "%s: error: %s\n", p.Repository, p.Error)
+		return
+	}
+	fmt.Fprintf(w, "%s: download %d files (%s), delete %d files (%s)\n",
+		p.Repository, len(p.Download), formatBytes(p.DownloadBytes),
+		len(p.Delete), formatBytes(p.DeleteBytes))
+	for _, file := range p.Held {
+		fmt.Fprintf(w, "  = %s held\n", file)
+	}
+	for _, f := range p.Download {
+		fmt.Fprintf(w, "  + %s (%s)\n", f.Name, formatBytes(f.Size))
+	}
+	for _, f := range p.Delete {
+		fmt.Fprintf(w, "  - %s (%s)\n", f.Name, formatBytes(f.Size))
+	}
+}
+
+// selectRepositories returns the repositories of conf named name, or all
+// of them if name is empty.
+func selectRepositories(conf *config.Config, name string) ([]*config.RepositoryConfig, error) {
+	if name == "" {
+		return conf.Repositories, nil
+	}
+	for _, repo := range conf.Repositories {
+		if repo.Name == name {
+			return []*config.RepositoryConfig{repo}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown repository %q", name)
+}
+
+// runPlan implements the plan command, it prints what an update of the
+// repositories would download and delete. It returns the exit status.
+func runPlan(conf *config.Config, args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print the plan as JSON")
+	name := flags.String("repo", "", "only plan the named repository")
+	flags.Parse(args)
+	repos, err := selectRepositories(conf, *name)
+	if err != nil {
+		slog.Error("invalid repository", "error", err)
+		return 2
+	}
+	defer func() {
+		for _, host := range hosts {
+			host.sched.Stop()
+		}
+	}()
+	ctx := context.Background()
+	status := 0
+	plans := []*plan{}
+	for _, repoconf := range repos {
+		p, err := func() (*plan, error) {
+			host, err := getHost(conf, upstreamHost(repoconf.Upstream))
+			if err != nil {
+				return nil, err
+			}
+			store, err := newStorage(conf, repoconf)
+			if err != nil {
+				return nil, err
+			}
+			return planRepository(ctx, repoconf, newUpstream(repoconf.Upstream, host), store)
+		}()
+		if err != nil {
+			slog.Error("planning failed", "repository", repoconf.Name, "error", err)
+			p = &plan{Repository: repoconf.Name, Error: err.Error()}
+			status = 1
+		}
+		plans = append(plans, p)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(plans)
+	} else {
+		for _, p := range plans {
+			p.writeText(os.Stdout)
+		}
+	}
+	return status
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+
+	repo := testFileRepository(t, ctx, upstream)
+	p, err := planRepository(ctx, repo.Config, repo.upstream, repo.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Download) != 2 || p.DownloadBytes != 6 || len(p.Delete) != 0 {
+		t.Errorf("expected to download everything, got %+v", p)
+	}
+
+	syncRepository(t, ctx, repo)
+	foo2 := testPkg(t, upstream, "foo-1.1_1", "foo 1.1")
+	writeRepodata(t, repodata, foo2, bar)
+	p, err = planRepository(ctx, repo.Config, repo.upstream, repo.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Download) != 1 || p.Download[0].Name != foo2.Filename() || p.DownloadBytes != foo2.Size {
+		t.Errorf("expected to download %s, got %+v", foo2.Filename(), p.Download)
+	}
+	// obsolete packages are kept forever by default
+	if len(p.Delete) != 0 {
+		t.Errorf("expected no deletions, got %+v", p.Delete)
+	}
+	repo.Config.ObsoleteMaxAge = time.Hour
+	p, err = planRepository(ctx, repo.Config, repo.upstream, repo.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Delete) != 1 || p.Delete[0].Name != foo.Filename() || p.DeleteBytes != foo.Size {
+		t.Errorf("expected to delete %s, got %+v", foo.Filename(), p.Delete)
+	}
+	var b strings.Builder
+	p.writeText(&b)
+	want := "test/x86_64: download 1 files (7 B), delete 1 files (3 B)\n" +
+		"  + foo-1.1_1.x86_64.xbps (7 B)\n" +
+		"  - foo-1.0_1.x86_64.xbps (3 B)\n"
+	if b.String() != want {
+		t.Errorf("unexpected text plan:\n%s", b.String())
+	}
+	assertStored(t, repo, foo.Filename())
+	if repo.Repodata.index["foo"].Pkgver != foo.Pkgver {
+		t.Errorf("expected planning not to change the repository")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1536:        "1.5 KiB",
+		5 << 20:     "5.0 MiB",
+		3 << 30 / 2: "1.5 GiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// stagedSuffix is the suffix of the temporary files of staged indexes.
+// They may wait for downloads longer than other temporary files live, so
+// they are not swept.
+const stagedSuffix = ".staged"
+
+// removeStaged removes the staged files left by a previous run. It must run
+// before any repository starts, as destinations can be shared.
+func removeStaged(repos []*config.RepositoryConfig) error {
+	seen := make(map[string]struct{})
+	for _, conf := range repos {
+		if _, ok := seen[conf.Destination]; ok {
+			continue
+		}
+		seen[conf.Destination] = struct{}{}
+		if err := removeStagedDir(conf.Destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeStagedDir(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, ".*"+stagedSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// stagedIndex is a fetched index that is published once the packages it
+// references are stored. An empty path deletes the index.
+type stagedIndex struct {
+	name string
+	path string
+	// snapshot keeps a snapshot of the index once it is published
+	snapshot bool
+	// rebuilt is set if the file is a package that was rebuilt upstream
+	// or its signature. It replaces the stored file and is not kept in
+	// the destination. An empty path is a failed download.
+	rebuilt *pkg
+}
+
+// stage replaces the index staged in *dst with idx. The temporary file of
+// an index that was replaced before it was published is removed.
+func stage(dst **stagedIndex, idx *stagedIndex) {
+	if old := *dst; old != nil && old.path != "" {
+		os.Remove(old.path)
+	}
+	*dst = idx
+}
+
+// publish stores the staged files in order and keeps a local copy of the
+// indexes. If a file fails to be stored, the following ones are discarded.
+func (r *Repository) publish(ctx context.Context, staged []*stagedIndex) error {
+	for i, idx := range staged {
+		local := filepath.Join(r.Config.Destination, idx.name)
+		var err error
+		if idx.rebuilt != nil {
+			var sum digest
+			if idx.name == idx.rebuilt.Filename() {
+				sum = idx.rebuilt.SHA256
+			}
+			if err = r.storage.Put(ctx, idx.name, idx.path, sum); err == nil {
+				// the local storage already moved it into place
+				os.Remove(idx.path)
+			}
+		} else if idx.path == "" {
+			if err = r.storage.Delete(ctx, idx.name); err == nil {
+				if err = os.Remove(local); os.IsNotExist(err) {
+					err = nil
+				}
+			}
+		} else if err = r.storage.Put(ctx, idx.name, idx.path, nil); err == nil {
+			// the local storage already moved it into place
+			if err = os.Rename(idx.path, local); os.IsNotExist(err) {
+				err = nil
+			}
+			if err == nil && idx.snapshot && r.Config.Snapshots > 0 {
+				if err := r.snapshot(time.Now()); err != nil {
+					r.log.Error("could not snapshot index", "name", idx.name, "error", err)
+				}
+			}
+		}
+		if err != nil {
+			for _, idx := range staged[i:] {
+				if idx.path != "" {
+					os.Remove(idx.path)
+				}
+			}
+			return err
+		}
+		r.log.Debug("published staged file", "name", idx.name)
+	}
+	return nil
+}
+
+// pendingDownload is a download queued by an update. pkg is set for the
+// downloads of a package or, if sig is set, its signature that are not
+// staged.
+type pendingDownload struct {
+	d   *download
+	pkg *pkg
+	sig bool
+}
+
+func (p pendingDownload) name() string {
+	if p.sig {
+		return p.pkg.Filename() + ".sig"
+	}
+	return p.pkg.Filename()
+}
+
+// deferredFiles are staged files held back until failed package downloads
+// succeed.
+type deferredFiles struct {
+	mu    sync.Mutex
+	files []*stagedIndex
+	// retries are the failed downloads that are not staged
+	retries []pendingDownload
+}
+
+// merge adds staged to the deferred files and failed to the retries. It
+// returns the files to publish, or the names of the missing downloads.
+func (d *deferredFiles) merge(staged []*stagedIndex, failed []pendingDownload) (ready []*stagedIndex, missing []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range failed {
+		d.fail(p)
+	}
+	for _, idx := range staged {
+		i := 0
+		for i < len(d.files) && d.files[i].name != idx.name {
+			i++
+		}
+		switch {
+		case i == len(d.files):
+			d.files = append(d.files, idx)
+		case idx.rebuilt != nil && idx.path == "" && d.files[i].path != "" &&
+			bytes.Equal(idx.rebuilt.SHA256, d.files[i].rebuilt.SHA256):
+			// a retry failed, but an earlier one succeeded
+		default:
+			if old := d.files[i]; old.path != "" && old.path != idx.path {
+				os.Remove(old.path)
+			}
+			d.files[i] = idx
+		}
+	}
+	// rebuilt packages come first, then the indexes in the order they
+	// were staged
+	var pkgs, indexes []*stagedIndex
+	for _, idx := range d.files {
+		if idx.rebuilt == nil {
+			indexes = append(indexes, idx)
+			continue
+		}
+		if idx.path == "" {
+			missing = append(missing, idx.name)
+		}
+		pkgs = append(pkgs, idx)
+	}
+	// retries taken by a later update are still missing for this one
+	seen := make(map[string]struct{})
+	for _, p := range append(failed, d.retries...) {
+		if _, ok := seen[p.name()]; !ok {
+			seen[p.name()] = struct{}{}
+			missing = append(missing, p.name())
+		}
+	}
+	if len(missing) > 0 {
+		return nil, missing
+	}
+	d.files = nil
+	return append(pkgs, indexes...), nil
+}
+
+// failed returns the rebuilt packages whose download failed.
+func (d *deferredFiles) failed() []*pkg {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var pkgs []*pkg
+	seen := make(map[*pkg]struct{})
+	for _, idx := range d.files {
+		if idx.rebuilt == nil || idx.path != "" {
+			continue
+		}
+		if _, ok := seen[idx.rebuilt]; !ok {
+			seen[idx.rebuilt] = struct{}{}
+			pkgs = append(pkgs, idx.rebuilt)
+		}
+	}
+	return pkgs
+}
+
+// fail adds the failed download p to the retries, d.mu must be held.
+func (d *deferredFiles) fail(p pendingDownload) {
+	for _, retry := range d.retries {
+		if retry.name() == p.name() {
+			return
+		}
+	}
+	d.retries = append(d.retries, p)
+}
+
+// retry returns the failed downloads and removes them from the retries.
+// The files stay deferred while they are downloaded again.
+func (d *deferredFiles) retry() []pendingDownload {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	retries := d.retries
+	d.retries = nil
+	return retries
+}
+
+// drop removes the deferred files of the rebuilt package pkg.
+func (d *deferredFiles) drop(pkg *pkg) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := d.files[:0]
+	for _, idx := range d.files {
+		if idx.rebuilt != nil && idx.rebuilt.Filename() == pkg.Filename() {
+			if idx.path != "" {
+				os.Remove(idx.path)
+			}
+			continue
+		}
+		files = append(files, idx)
+	}
+	d.files = files
+}
+
+// waitSync publishes the staged files once the downloads and the previous
+// update are done, then closes done.
+func (r *Repository) waitSync(prev <-chan struct{}, done chan struct{}, pending []pendingDownload, staged []*stagedIndex, changed bool) {
+	defer close(done)
+	ev := newEvent(config.EventSync, r.Config)
+	var failed []pendingDownload
+	for _, p := range pending {
+		if err := p.d.Wait(); err != nil {
+			ev.Failed++
+			if p.pkg != nil {
+				failed = append(failed, p)
+			}
+		}
+	}
+	if prev != nil {
+		<-prev
+	}
+	r.synced = nil
+	staged, missing := r.deferred.merge(staged, failed)
+	if len(missing) > 0 {
+		err := fmt.Errorf("packages could not be downloaded, the indexes are not published: %s", strings.Join(missing, ", "))
+		r.log.Error("deferring indexes", "error", err)
+		ev.Error = err.Error()
+		r.synced = err
+	} else if err := r.publish(r.ctx, staged); err != nil {
+		r.log.Error("publishing indexes failed", "error", err)
+		ev.Error = err.Error()
+		r.synced = err
+	} else if ev.Failed > 0 {
+		r.synced = fmt.Errorf("%d downloads failed", ev.Failed)
+	}
+	if !changed {
+		return
+	}
+	ev.Time = time.Now()
+	emit(ev)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// quarantineDir is the directory in the destination that downloads which
+// failed verification are moved to for inspection.
+const quarantineDir = ".quarantine"
+
+// Reasons a file is quarantined for.
+const (
+	quarantineChecksum  = "checksum"
+	quarantineSignature = "signature"
+)
+
+// quarantined describes a quarantined file. It is stored next to the file
+// with a ".json" suffix.
+type quarantined struct {
+	// ID is the name of the file in the quarantine directory.
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Repository string      `json:"repository"`
+	Reason     string      `json:"reason"`
+	URL        string      `json:"url,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Expected   string      `json:"expected_sha256,omitempty"`
+	Actual     string      `json:"actual_sha256,omitempty"`
+	Size       int64       `json:"size"`
+	Error      string      `json:"error"`
+	Time       time.Time   `json:"time"`
+}
+
+// quarantine moves the file at path, which failed verification, into the
+// quarantine directory with the metadata in q and emits a quarantine
+// event. The name, reason and error of q must be set.
+func (r *Repository) quarantine(path string, q *quarantined) {
+	dir := filepath.Join(r.Config.Destination, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.log.Error("could not create quarantine directory", "path", dir, "error", err)
+		return
+	}
+	q.Repository = r.Config.Name
+	q.Time = time.Now().UTC()
+	q.ID = q.Time.Format("20060102T150405.000000000Z") + "-" + q.Name
+	if q.URL == "" {
+		if u, err := r.upstream.Request(q.Name).URL(); err == nil {
+			q.URL = u.String()
+		}
+	}
+	if info, err := os.Stat(path); err == nil {
+		q.Size = info.Size()
+	}
+	meta, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		r.log.Error("could not encode quarantine metadata", "name", q.Name, "error", err)
+		return
+	}
+	dst := filepath.Join(dir, q.ID)
+	if err := os.WriteFile(dst+".json", append(meta, '\n'), 0644); err != nil {
+		r.log.Error("could not write quarantine metadata", "path", dst+".json", "error", err)
+		return
+	}
+	if err := os.Rename(path, dst); err != nil {
+		r.log.Error("could not quarantine file", "path", path, "error", err)
+		os.Remove(dst + ".json")
+		return
+	}
+	quarantined_files_total.WithLabelValues(r.Config.Name, q.Reason).Inc()
+	r.log.Warn("quarantined file", "name", q.Name, "path", dst, "reason", q.Reason, "error", q.Error)
+	ev := newEvent(config.EventQuarantine, r.Config)
+	ev.File = q.Name
+	ev.Error = q.Error
+	emit(ev)
+}
+
+// listQuarantine returns the quarantined files in the quarantine
+// directory of the destination dir. Files with unreadable metadata are
+// skipped.
+func listQuarantine(dir string) ([]*quarantined, error) {
+	dir = filepath.Join(dir, quarantineDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []*quarantined
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("could not read quarantine metadata", "path", path, "error", err)
+			continue
+		}
+		var q quarantined
+		if err := json.Unmarshal(data, &q); err != nil {
+			slog.Error("invalid quarantine metadata", "path", path, "error", err)
+			continue
+		}
+		files = append(files, &q)
+	}
+	return files, nil
+}
+
+// sweepQuarantine removes the files in the quarantine directory of the
+// destination dir that were modified longer than maxAge ago. It goes by
+// the age of each file, so files whose metadata is missing or broken are
+// removed as well.
+func sweepQuarantine(dir string, maxAge time.Duration, now time.Time) error {
+	dir = filepath.Join(dir, quarantineDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		age := now.Sub(info.ModTime())
+		if age < maxAge {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("could not delete quarantined file", "path", path, "error", err)
+			continue
+		}
+		slog.Info("deleted quarantined file", "path", path, "age", age)
+	}
+	return nil
+}
+
+// quarantineHandler lists the quarantined files of all repositories as
+// JSON, optionally limited to the repository named by the "repository"
+// query parameter.
+type quarantineHandler struct {
+	repos []*Repository
+}
+
+func (h *quarantineHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("repository")
+	files := []*quarantined{}
+	seen := make(map[string]struct{})
+	for _, repo := range h.repos {
+		// repositories may share a destination
+		dir := filepath.Clean(repo.Config.Destination)
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		list, err := listQuarantine(dir)
+		if err != nil {
+			slog.Error("listing quarantine failed", "path", dir, "error", err)
+			http.Error(w, "listing quarantine failed", http.StatusInternalServerError)
+			return
+		}
+		for _, q := range list {
+			if name == "" || q.Repository == name {
+				files = append(files, q)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Time.Before(files[j].Time)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuarantineChecksumMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+	// upstream replaced the package without updating the index
+	testPkg(t, upstream, "foo-1.0_1", "corrupt")
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	if _, err := os.Stat(filepath.Join(repo.Config.Destination, foo.Filename())); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupt package not to be published")
+	}
+
+	// broken metadata does not hide the other quarantined files
+	broken := filepath.Join(repo.Config.Destination, quarantineDir, "broken.json")
+	if err := os.WriteFile(broken, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h := &quarantineHandler{repos: []*Repository{repo}}
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quarantine?repository=test/x86_64", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var files []*quarantined
+	if err := json.NewDecoder(rec.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 quarantined file, got %d", len(files))
+	}
+	q := files[0]
+	if q.Name != foo.Filename() || q.Reason != quarantineChecksum || q.Expected != hex.EncodeToString(foo.SHA256) || q.Size != int64(len("corrupt")) {
+		t.Errorf("unexpected quarantine metadata: %+v", q)
+	}
+	if q.URL != "file://"+filepath.Join(upstream, foo.Filename()) {
+		t.Errorf("unexpected url %q", q.URL)
+	}
+	data, err := os.ReadFile(filepath.Join(repo.Config.Destination, quarantineDir, q.ID))
+	if err != nil || string(data) != "corrupt" {
+		t.Errorf("expected the download to be kept as evidence: %q %v", data, err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quarantine?repository=other", nil))
+	if body := rec.Body.String(); body != "[]\n" {
+		t.Errorf("expected no files of other repositories, got %s", body)
+	}
+
+	// retention
+	if err := sweepQuarantine(repo.Config.Destination, time.Hour, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := listQuarantine(repo.Config.Destination); len(files) != 1 {
+		t.Errorf("expected a fresh quarantined file to be kept")
+	}
+	// files without metadata or with broken metadata are swept by age
+	for name, content := range map[string]string{"orphan": "corrupt"} {
+		if err := os.WriteFile(filepath.Join(repo.Config.Destination, quarantineDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sweepQuarantine(repo.Config.Destination, time.Hour, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := listQuarantine(repo.Config.Destination); len(files) != 0 {
+		t.Errorf("expected an old quarantined file to be removed, got %+v", files)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(repo.Config.Destination, quarantineDir)); len(entries) != 0 {
+		t.Errorf("expected all quarantined files to be removed, got %v", entries)
+	}
+}
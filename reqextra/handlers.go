@@ -20,13 +20,16 @@ func ToTemp(dir, pattern string, tmpfile *string) requests.ResponseHandler {
 		if err != nil {
 			return err
 		}
-		*tmpfile = file.Name()
 		if _, err := io.Copy(file, resp.Body); err != nil {
+			file.Close()
+			os.Remove(file.Name())
 			return err
 		}
 		if err := file.Close(); err != nil {
+			os.Remove(file.Name())
 			return err
 		}
+		*tmpfile = file.Name()
 		return nil
 	}
 }
@@ -73,17 +76,33 @@ func HashResponse(hash hash.Hash, handler requests.ResponseHandler) requests.Res
 	}
 }
 
+// ChecksumError is returned by Sha256Verify if the response body does not
+// match the expected checksum.
+type ChecksumError struct {
+	Response *http.Response
+	Got      []byte
+	Expected []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: checksum mismatch: got %q, expected %q",
+		e.Unwrap(), hex.EncodeToString(e.Got), hex.EncodeToString(e.Expected))
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return (*requests.ResponseError)(e.Response)
+}
+
 func Sha256Verify(sum []byte, handler requests.ResponseHandler) requests.ResponseHandler {
-	hash := sha256.New()
-	handler = HashResponse(hash, handler)
 	return func(resp *http.Response) error {
-		if err := handler(resp); err != nil {
+		// the hash is per response so that failed requests can be retried
+		hash := sha256.New()
+		if err := HashResponse(hash, handler)(resp); err != nil {
 			return err
 		}
 		res := hash.Sum(nil)
 		if !bytes.Equal(res, sum) {
-			return fmt.Errorf("%w: checksum mismatch: got %q, expected %q",
-				(*requests.ResponseError)(resp), hex.EncodeToString(res), hex.EncodeToString(sum))
+			return &ChecksumError{Response: resp, Got: res, Expected: sum}
 		}
 		return nil
 	}
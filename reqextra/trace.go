@@ -0,0 +1,51 @@
+package reqextra
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/carlmjohnson/requests"
+)
+
+type spanCloser struct {
+	io.ReadCloser
+	once sync.Once
+	span trace.Span
+}
+
+func (c *spanCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { c.span.End() })
+	return err
+}
+
+// TraceTransport returns a transport that records a client span for every
+// request as child of the span in the request's context. The span ends when
+// the response body is closed, so it covers the whole transfer.
+func TraceTransport(rt http.RoundTripper, tracer trace.Tracer) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return requests.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(httpconv.ClientRequest(req)...),
+		)
+		resp, err := rt.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			return resp, err
+		}
+		span.SetAttributes(httpconv.ClientResponse(resp)...)
+		span.SetStatus(httpconv.ClientStatus(resp.StatusCode))
+		resp.Body = &spanCloser{ReadCloser: resp.Body, span: span}
+		return resp, nil
+	})
+}
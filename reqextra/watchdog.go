@@ -0,0 +1,89 @@
+package reqextra
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+)
+
+// ErrStalled is returned by reads from a response body that was aborted by
+// the Watchdog transport.
+var ErrStalled = errors.New("transfer stalled")
+
+type watchdog struct {
+	rc      io.ReadCloser
+	timeout time.Duration
+	min     int64
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	read    int64
+	stalled bool
+	closed  bool
+}
+
+func (w *watchdog) Read(p []byte) (int, error) {
+	n, err := w.rc.Read(p)
+	w.mu.Lock()
+	w.read += int64(n)
+	if w.stalled {
+		err = ErrStalled
+	} else if err != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+	return n, err
+}
+
+func (w *watchdog) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.timer.Stop()
+	w.mu.Unlock()
+	return w.rc.Close()
+}
+
+// check aborts the transfer if not more than min bytes were read since
+// the last check.
+func (w *watchdog) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if w.read <= w.min {
+		w.stalled = true
+		// closing the body unblocks a pending Read
+		w.rc.Close()
+		return
+	}
+	w.read = 0
+	w.timer.Reset(w.timeout)
+}
+
+// Watchdog returns a transport that aborts the transfer of response
+// bodies with ErrStalled if at most minBytes were received within timeout.
+func Watchdog(rt http.RoundTripper, timeout time.Duration, minBytes int64) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if timeout <= 0 {
+		return rt
+	}
+	return requests.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		w := &watchdog{rc: resp.Body, timeout: timeout, min: minBytes}
+		w.mu.Lock()
+		w.timer = time.AfterFunc(timeout, w.check)
+		w.mu.Unlock()
+		resp.Body = w
+		return resp, nil
+	})
+}
@@ -0,0 +1,61 @@
+package reqextra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+)
+
+func TestWatchdog(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	err := requests.URL(srv.URL).
+		Transport(Watchdog(nil, 50*time.Millisecond, 0)).
+		Handle(func(resp *http.Response) error {
+			_, err := io.Copy(io.Discard, resp.Body)
+			return err
+		}).
+		Fetch(context.Background())
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("expected ErrStalled, got %v", err)
+	}
+}
+
+func TestWatchdogProgress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	var body string
+	err := requests.URL(srv.URL).
+		Transport(Watchdog(nil, 50*time.Millisecond, 0)).
+		ToString(&body).
+		Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "chunkchunkchunkchunkchunk" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,259 @@
+// Package sched implements a download scheduler that shares a fixed number
+// of workers between groups of jobs.
+//
+// Groups are served using stride scheduling: every group has a weight and
+// each dispatched job advances the group's pass by the inverse of its
+// weight. The non-empty group with the lowest pass runs next, so a group
+// with weight 4 gets four times the share of a group with weight 1, but
+// no group is ever starved. Within a group, smaller jobs run first, but a
+// job is only overtaken by one later job per agingBytes of its size, so
+// large jobs are not starved by a stream of small ones either.
+package sched
+
+import (
+	"container/heap"
+	"runtime/debug"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// stride is the pass increment for a group with weight 1.
+const stride = 1 << 20
+
+// agingBytes is the job size that lets one later submitted job run first.
+const agingBytes = 1 << 20
+
+// A Job is a unit of work submitted to the Scheduler.
+type Job struct {
+	// Group is the name of the group the job is accounted to.
+	Group string
+	// Size orders jobs within a group, smaller runs first, within the
+	// bounds of agingBytes.
+	Size int64
+	// Run is called by a worker to do the work.
+	Run func()
+
+	seq uint64
+	// deadline is the seq of the last job that may run before this one
+	deadline uint64
+}
+
+type jobs []*Job
+
+func (q jobs) Len() int { return len(q) }
+
+func (q jobs) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if a.deadline != b.deadline {
+		return a.deadline < b.deadline
+	}
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+	return a.seq < b.seq
+}
+
+func (q jobs) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobs) Push(x any) { *q = append(*q, x.(*Job)) }
+
+func (q *jobs) Pop() any {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return job
+}
+
+type group struct {
+	name    string
+	weight  int
+	pass    uint64
+	jobs    jobs
+	running int
+}
+
+// Scheduler runs submitted jobs on a fixed number of workers.
+type Scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	groups  map[string]*group
+	workers int
+	waiting int
+	seq     uint64
+	stopped bool
+	wg      sync.WaitGroup
+	// idle is signaled when a group runs out of jobs
+	idle *sync.Cond
+}
+
+// New creates a Scheduler and starts its workers.
+func New(workers int) *Scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	s := &Scheduler{
+		groups:  make(map[string]*group),
+		workers: workers,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.idle = sync.NewCond(&s.mu)
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *Scheduler) group(name string) *group {
+	g, ok := s.groups[name]
+	if !ok {
+		g = &group{name: name, weight: 1}
+		s.groups[name] = g
+	}
+	return g
+}
+
+// SetWeight sets the share of workers the group receives relative to
+// other groups. Weights lower than 1 are treated as 1.
+func (s *Scheduler) SetWeight(name string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group(name).weight = weight
+}
+
+// minPass returns the lowest pass of all groups with waiting jobs.
+func (s *Scheduler) minPass() (uint64, bool) {
+	var lowest uint64
+	found := false
+	for _, g := range s.groups {
+		if len(g.jobs) > 0 && (!found || g.pass < lowest) {
+			lowest, found = g.pass, true
+		}
+	}
+	return lowest, found
+}
+
+// Submit queues job to be run by one of the workers.
+// Jobs submitted after Stop are discarded.
+func (s *Scheduler) Submit(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	g := s.group(job.Group)
+	if len(g.jobs) == 0 {
+		// A group that was idle must not be able to catch up on the
+		// share it did not use, it joins at the current pass.
+		if pass, ok := s.minPass(); ok && g.pass < pass {
+			g.pass = pass
+		}
+	}
+	s.seq++
+	job.seq = s.seq
+	job.deadline = job.seq
+	if job.Size > 0 {
+		job.deadline += uint64(job.Size / agingBytes)
+	}
+	heap.Push(&g.jobs, job)
+	s.waiting++
+	s.cond.Signal()
+}
+
+// next removes the next job to run, it must be called with s.mu held.
+func (s *Scheduler) next() *Job {
+	var next *group
+	for _, g := range s.groups {
+		if len(g.jobs) == 0 {
+			continue
+		}
+		if next == nil || g.pass < next.pass || (g.pass == next.pass && g.name < next.name) {
+			next = g
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	next.pass += stride / uint64(next.weight)
+	next.running++
+	s.waiting--
+	return heap.Pop(&next.jobs).(*Job)
+}
+
+func (s *Scheduler) worker() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		for !s.stopped && s.waiting == 0 {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		job := s.next()
+		s.mu.Unlock()
+		runJob(job)
+		s.mu.Lock()
+		g := s.groups[job.Group]
+		g.running--
+		if g.running == 0 && len(g.jobs) == 0 {
+			s.idle.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// runJob runs job and recovers from a panic, so that the job is still
+// accounted as done and the worker keeps running.
+func runJob(job *Job) {
+	defer func() {
+		if v := recover(); v != nil {
+			slog.Error("job panicked", "group", job.Group, "panic", v, "stack", string(debug.Stack()))
+		}
+	}()
+	job.Run()
+}
+
+// Drain blocks until the group has no waiting or running jobs. Jobs
+// submitted while it waits are waited for as well.
+func (s *Scheduler) Drain(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.group(name)
+	for len(g.jobs) > 0 || g.running > 0 {
+		s.idle.Wait()
+	}
+}
+
+// Workers returns the number of workers.
+func (s *Scheduler) Workers() int {
+	return s.workers
+}
+
+// WaitingQueueSize returns the number of jobs waiting for a worker.
+func (s *Scheduler) WaitingQueueSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiting
+}
+
+// Stop discards all waiting jobs and waits for running jobs to finish.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, g := range s.groups {
+		g.jobs = nil
+	}
+	s.waiting = 0
+	s.cond.Broadcast()
+	s.idle.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
@@ -0,0 +1,152 @@
+package sched
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// run submits jobs to a single worker while it is blocked and returns the
+// order in which they ran.
+func run(t *testing.T, setup func(*Scheduler), submit []*Job) []string {
+	t.Helper()
+	s := New(1)
+	if setup != nil {
+		setup(s)
+	}
+	block := make(chan struct{})
+	started := make(chan struct{})
+	s.Submit(&Job{Group: "block", Run: func() {
+		close(started)
+		<-block
+	}})
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, job := range submit {
+		name := job.Group
+		if job.Size != 0 {
+			name = job.Group + "/big"
+		}
+		wg.Add(1)
+		job.Run = func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			wg.Done()
+		}
+		s.Submit(job)
+	}
+	close(block)
+	wg.Wait()
+	s.Stop()
+	return order
+}
+
+func TestOrderWithinGroup(t *testing.T) {
+	order := run(t, nil, []*Job{
+		{Group: "a", Size: 10 * agingBytes},
+		{Group: "a"},
+	})
+	want := []string{"a", "a/big"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got %v, want %v", order, want)
+	}
+}
+
+func TestAging(t *testing.T) {
+	submit := []*Job{{Group: "a", Size: 10 * agingBytes}}
+	for i := 0; i < 20; i++ {
+		submit = append(submit, &Job{Group: "a"})
+	}
+	order := run(t, nil, submit)
+	// the big job is overtaken by 10 small jobs only
+	for i, name := range order {
+		if name == "a/big" && i != 10 {
+			t.Errorf("big job ran at position %d, want 10", i)
+		}
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	var submit []*Job
+	for i := 0; i < 4; i++ {
+		submit = append(submit, &Job{Group: "a"})
+	}
+	for i := 0; i < 4; i++ {
+		submit = append(submit, &Job{Group: "b"})
+	}
+	order := run(t, nil, submit)
+	want := []string{"a", "b", "a", "b", "a", "b", "a", "b"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got %v, want %v", order, want)
+	}
+}
+
+func TestWeight(t *testing.T) {
+	var submit []*Job
+	for i := 0; i < 6; i++ {
+		submit = append(submit, &Job{Group: "a"})
+	}
+	for i := 0; i < 2; i++ {
+		submit = append(submit, &Job{Group: "b"})
+	}
+	order := run(t, func(s *Scheduler) {
+		s.SetWeight("b", 2)
+	}, submit)
+	// b has twice the share of a
+	want := []string{"a", "b", "b", "a", "a", "a", "a", "a"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got %v, want %v", order, want)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := New(2)
+	defer s.Stop()
+	block := make(chan struct{})
+	var mu sync.Mutex
+	var ran []string
+	for _, group := range []string{"a", "a", "b"} {
+		group := group
+		s.Submit(&Job{Group: group, Run: func() {
+			if group == "b" {
+				<-block
+			}
+			mu.Lock()
+			ran = append(ran, group)
+			mu.Unlock()
+		}})
+	}
+	// a drains while b is still running
+	s.Drain("a")
+	mu.Lock()
+	if len(ran) != 2 || ran[0] != "a" || ran[1] != "a" {
+		t.Errorf("expected the jobs of a to have run, got %v", ran)
+	}
+	mu.Unlock()
+	close(block)
+	s.Drain("b")
+	if len(ran) != 3 {
+		t.Errorf("expected all jobs to have run, got %v", ran)
+	}
+	// a group without jobs is drained
+	s.Drain("c")
+}
+
+func TestPanic(t *testing.T) {
+	s := New(1)
+	s.Submit(&Job{Group: "a", Run: func() { panic("boom") }})
+	ran := make(chan struct{})
+	s.Submit(&Job{Group: "a", Run: func() { close(ran) }})
+	// the worker survives the panic and the group is drained
+	s.Drain("a")
+	select {
+	case <-ran:
+	default:
+		t.Error("expected the job after the panic to run")
+	}
+	s.Stop()
+}
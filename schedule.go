@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// nextUpdate returns when the repository should be polled after t, or the
+// zero time if it is only updated when triggered.
+func nextUpdate(conf *config.RepositoryConfig, t time.Time) time.Time {
+	if !conf.Poll {
+		return time.Time{}
+	}
+	var next time.Time
+	if conf.Schedule != nil {
+		next = conf.Schedule.Next(t)
+		if next.IsZero() {
+			return next
+		}
+	} else {
+		next = t.Add(*conf.Interval)
+	}
+	if jitter := *conf.Jitter; jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return next
+}
+
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = 15 * time.Minute
+)
+
+// backoff returns how long to wait before retrying after the given number
+// of consecutive failures.
+func backoff(failures int) time.Duration {
+	d := minBackoff
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
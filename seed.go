@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Duncaen/go-xbps/util"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// rsyncPath is the rsync binary used to seed repositories.
+var rsyncPath = "rsync"
+
+// seedDir is the staging directory in the destination rsync transfers
+// into. It is kept between attempts so interrupted transfers resume.
+const seedDir = ".seed"
+
+var (
+	// seedIOTimeout aborts rsync if no data moves for this long
+	seedIOTimeout = 5 * time.Minute
+	// seedTimeout bounds a seed, the packages it did not transfer are
+	// downloaded over HTTP
+	seedTimeout = time.Hour
+)
+
+// rsync copies files from src into dir.
+func rsync(ctx context.Context, src string, dir string, files []string) error {
+	cmd := exec.CommandContext(ctx, rsyncPath,
+		"--times",
+		"--partial-dir=.partial",
+		fmt.Sprintf("--timeout=%d", int(seedIOTimeout.Seconds())),
+		"--files-from=-",
+		strings.TrimSuffix(src, "/")+"/",
+		dir+"/",
+	)
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	// do not wait for the output of a killed transfer
+	cmd.WaitDelay = 10 * time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rsync: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// adoptSeeded stores the packages and signatures rsync brought into dir if
+// their checksums match the index and the signatures verify. It returns
+// the packages that are still missing, missing signatures are queued.
+func (r *Repository) adoptSeeded(ctx context.Context, dir string, pkgs []*pkg) []*pkg {
+	var missing []*pkg
+	key := r.signingKey()
+	for _, pkg := range pkgs {
+		binpkg := pkg.Filename()
+		staged := filepath.Join(dir, binpkg)
+		sum, err := util.FileSha256(staged)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.log.Error("could not hash seeded package", "path", staged, "error", err)
+			}
+			missing = append(missing, pkg)
+			continue
+		}
+		if !bytes.Equal(sum, pkg.SHA256) {
+			r.log.Error("seeded package checksum mismatch", "path", staged)
+			r.quarantine(staged, &quarantined{
+				Name:     binpkg,
+				Reason:   quarantineChecksum,
+				URL:      r.Config.Seed.JoinPath(binpkg).String(),
+				Expected: hex.EncodeToString(pkg.SHA256),
+				Actual:   hex.EncodeToString(sum),
+				Error:    "seeded package checksum mismatch",
+			})
+			os.Remove(staged)
+			missing = append(missing, pkg)
+			continue
+		}
+		sigfile := filepath.Join(dir, binpkg+".sig")
+		var sigErr error
+		if _, err := os.Stat(sigfile); err != nil {
+			sigErr = fmt.Errorf("%w: %s", errUnsignedPackage, binpkg)
+		} else if key != nil || r.Config.RequireSignatures {
+			sigErr = r.checkSig(key, pkg, sigfile)
+		}
+		if sigErr != nil && r.Config.RequireSignatures {
+			r.log.Error("refusing seeded package", "path", staged, "error", sigErr)
+			os.Remove(staged)
+			os.Remove(sigfile)
+			missing = append(missing, pkg)
+			continue
+		}
+		err = r.storage.Put(ctx, binpkg, staged, pkg.SHA256)
+		os.Remove(staged)
+		if err != nil {
+			r.log.Error("could not store seeded package", "path", staged, "error", err)
+			missing = append(missing, pkg)
+			continue
+		}
+		if sigErr != nil {
+			os.Remove(sigfile)
+			r.queueSig(ctx, pkg, nil)
+			continue
+		}
+		err = r.storage.Put(ctx, binpkg+".sig", sigfile, nil)
+		os.Remove(sigfile)
+		if err != nil {
+			r.log.Error("could not store seeded signature", "path", sigfile, "error", err)
+		}
+	}
+	return missing
+}
+
+// seed transfers pkgs and their signatures with rsync from the seed
+// upstream and returns the packages it could not provide, which are then
+// downloaded over HTTP.
+func (r *Repository) seed(ctx context.Context, pkgs []*pkg) ([]*pkg, error) {
+	ctx, span := tracer.Start(ctx, "seed")
+	span.SetAttributes(attribute.Int("packages", len(pkgs)))
+	dir := filepath.Join(r.Config.Destination, seedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		endSpan(span, err)
+		return pkgs, err
+	}
+	files := make([]string, 0, len(pkgs)*2)
+	for _, pkg := range pkgs {
+		files = append(files, pkg.Filename(), pkg.Filename()+".sig")
+	}
+	r.log.Info("seeding packages", "seed", r.Config.Seed, "packages", len(pkgs))
+	rctx, cancel := context.WithTimeout(ctx, seedTimeout)
+	err := rsync(rctx, r.Config.Seed.String(), dir, files)
+	cancel()
+	if err != nil {
+		// files that were transferred before the error are still used
+		r.log.Error("seeding failed", "seed", r.Config.Seed, "error", err)
+	}
+	missing := r.adoptSeeded(ctx, dir, pkgs)
+	seeded_packages_total.WithLabelValues(r.Config.Name).Add(float64(len(pkgs) - len(missing)))
+	r.log.Info("seeded packages", "seeded", len(pkgs)-len(missing), "missing", len(missing))
+	if len(missing) == 0 {
+		os.RemoveAll(dir)
+	}
+	endSpan(span, err)
+	return missing, nil
+}
+
+// fetchPkgs queues the downloads of pkgs, seeding them with rsync first if
+// there are enough of them.
+func (r *Repository) fetchPkgs(ctx context.Context, pkgs []*pkg) {
+	seen := make(map[string]struct{}, len(pkgs))
+	unique := pkgs[:0]
+	for _, pkg := range pkgs {
+		if _, ok := seen[pkg.Filename()]; ok {
+			continue
+		}
+		// packages of an index that was not published before a restart
+		if _, ok := r.files[pkg.Filename()]; ok {
+			continue
+		}
+		seen[pkg.Filename()] = struct{}{}
+		unique = append(unique, pkg)
+	}
+	pkgs = unique
+	if r.Config.Seed != nil && len(pkgs) >= r.Config.SeedThreshold {
+		missing, err := r.seed(ctx, pkgs)
+		if err != nil {
+			r.log.Error("seeding failed", "seed", r.Config.Seed, "error", err)
+		}
+		pkgs = missing
+	}
+	for _, pkg := range pkgs {
+		r.queuePkg(ctx, pkg, nil)
+		r.queueSig(ctx, pkg, nil)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeRsync replaces rsync with script for the duration of the test. The
+// script gets the arguments of rsync.
+func fakeRsync(t *testing.T, script string) {
+	path := filepath.Join(t.TempDir(), "rsync")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := rsyncPath
+	rsyncPath = path
+	t.Cleanup(func() { rsyncPath = old })
+}
+
+// copyRsync copies the listed files that exist from the source directory.
+const copyRsync = `for last; do :; done
+src=$(eval echo \${$(($# - 1))})
+src=${src#rsync://}
+while read -r f; do
+	[ -e "$src/$f" ] && cp "$src/$f" "$last"
+done
+exit 0
+`
+
+func testSeedRepository(t *testing.T, ctx context.Context, upstream, seed string) *Repository {
+	repo := testFileRepository(t, ctx, upstream)
+	repo.Config.Seed = &url.URL{Scheme: "rsync", Path: seed}
+	repo.Config.SeedThreshold = 1
+	return repo
+}
+
+func TestSeedMissingSignature(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream, seed := t.TempDir(), t.TempDir()
+	foo := testSignedPkg(t, upstream, "foo-1.0_1", "foo")
+	// the seed has the package but not its signature
+	testPkg(t, seed, "foo-1.0_1", "foo")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+	fakeRsync(t, copyRsync)
+
+	repo := testSeedRepository(t, ctx, upstream, seed)
+	syncRepository(t, ctx, repo)
+	assertStored(t, repo, foo.Filename(), foo.Filename()+".sig")
+}
+
+func TestSeedTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream, seed := t.TempDir(), t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+	fakeRsync(t, "exec sleep 60\n")
+	old := seedTimeout
+	seedTimeout = 100 * time.Millisecond
+	defer func() { seedTimeout = old }()
+
+	repo := testSeedRepository(t, ctx, upstream, seed)
+	start := time.Now()
+	syncRepository(t, ctx, repo)
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("seed took %v", d)
+	}
+	// the package is downloaded over HTTP instead
+	assertStored(t, repo, foo.Filename())
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Duncaen/go-xbps/util"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// snapshotDir is the directory in the destination that keeps the daily
+// snapshots of the repodata, in a directory per date.
+const snapshotDir = ".snapshots"
+
+const snapshotDateFormat = "2006-01-02"
+
+var errNoSnapshot = errors.New("no such snapshot")
+
+// snapshots are the indexes of the snapshots of a repository by date.
+type snapshots struct {
+	mu      sync.Mutex
+	indexes map[string]index
+}
+
+func (r *Repository) snapshotPath(date string) string {
+	return filepath.Join(r.Config.Destination, snapshotDir, date, fmt.Sprintf("%s-repodata", r.Config.Architecture))
+}
+
+// loadSnapshots reads the snapshots of the repository from the
+// destination.
+func (r *Repository) loadSnapshots() error {
+	r.snapshots.indexes = make(map[string]index)
+	entries, err := os.ReadDir(filepath.Join(r.Config.Destination, snapshotDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(snapshotDateFormat, entry.Name()); err != nil {
+			continue
+		}
+		// the destination may be shared with other architectures
+		idx, _, err := readRepodata(r.snapshotPath(entry.Name()))
+		if err != nil {
+			return err
+		}
+		if idx != nil {
+			r.snapshots.indexes[entry.Name()] = idx
+		}
+	}
+	return nil
+}
+
+// dates returns the dates of the snapshots, oldest first.
+func (s *snapshots) dates() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dates := make([]string, 0, len(s.indexes))
+	for date := range s.indexes {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+func (s *snapshots) index(date string) index {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.indexes[date]
+}
+
+// files returns the names of the packages and signatures referenced by
+// the snapshots.
+func (s *snapshots) files() map[string]struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]struct{})
+	for _, idx := range s.indexes {
+		for _, pkg := range idx {
+			files[pkg.Filename()] = struct{}{}
+			files[pkg.Filename()+".sig"] = struct{}{}
+		}
+	}
+	return files
+}
+
+// copyFile copies src to a new temporary file in dir created with
+// pattern and returns its path.
+func copyFile(src, dir, pattern string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// snapshot copies the published repodata into the snapshot of the day of
+// now, replacing an earlier snapshot of the same day, and removes the
+// oldest snapshots beyond the configured number.
+func (r *Repository) snapshot(now time.Time) error {
+	file := fmt.Sprintf("%s-repodata", r.Config.Architecture)
+	date := now.Format(snapshotDateFormat)
+	dst := r.snapshotPath(date)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmpfile, err := copyFile(filepath.Join(r.Config.Destination, file), filepath.Dir(dst), "."+file+".*")
+	if err != nil {
+		return err
+	}
+	idx, _, err := readRepodata(tmpfile)
+	if err == nil {
+		err = os.Rename(tmpfile, dst)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	r.log.Debug("snapshot taken", "snapshot", date)
+	r.snapshots.mu.Lock()
+	r.snapshots.indexes[date] = idx
+	r.snapshots.mu.Unlock()
+
+	dates := r.snapshots.dates()
+	if len(dates) <= r.Config.Snapshots {
+		return nil
+	}
+	for _, old := range dates[:len(dates)-r.Config.Snapshots] {
+		path := r.snapshotPath(old)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// fails while other architectures keep a snapshot of that date
+		os.Remove(filepath.Dir(path))
+		r.snapshots.mu.Lock()
+		delete(r.snapshots.indexes, old)
+		r.snapshots.mu.Unlock()
+		r.log.Info("removed snapshot", "snapshot", old)
+	}
+	return nil
+}
+
+// holdPath is the file that records the sha256 of the upstream repodata
+// that was rolled back.
+func holdPath(conf *config.RepositoryConfig) string {
+	return filepath.Join(conf.Destination, snapshotDir, fmt.Sprintf("%s-repodata.hold", conf.Architecture))
+}
+
+func readHold(conf *config.RepositoryConfig) (digest, error) {
+	data, err := os.ReadFile(holdPath(conf))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// writeHold records sum as the held upstream repodata, a nil sum removes
+// the hold.
+func writeHold(conf *config.RepositoryConfig, sum digest) error {
+	path := holdPath(conf)
+	if sum == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(sum)+"\n"), 0644)
+}
+
+// rollbackRequest asks the update loop of a repository to roll back to the
+// snapshot of date.
+type rollbackRequest struct {
+	date string
+	done chan error
+}
+
+// Rollback publishes the repodata of the snapshot of date as the live
+// repodata. The upstream repodata is ignored until it changes.
+func (r *Repository) Rollback(ctx context.Context, date string) error {
+	req := &rollbackRequest{date: date, done: make(chan error, 1)}
+	select {
+	case r.rollbacks <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rollback implements Rollback, it must only be called by the update
+// loop.
+func (r *Repository) rollback(ctx context.Context, date string) error {
+	if _, err := time.Parse(snapshotDateFormat, date); err != nil {
+		return errNoSnapshot
+	}
+	src := r.snapshotPath(date)
+	idx, key, err := readRepodata(src)
+	if err != nil {
+		return err
+	}
+	if idx == nil {
+		return errNoSnapshot
+	}
+	file := fmt.Sprintf("%s-repodata", r.Config.Architecture)
+	hold := r.Repodata.hold
+	if hold == nil {
+		hold = r.Repodata.sum
+	}
+	if hold == nil {
+		// nothing was fetched since the start, the live repodata is the
+		// last one fetched from upstream
+		if hold, err = util.FileSha256(filepath.Join(r.Config.Destination, file)); err != nil {
+			return err
+		}
+	}
+	tmpfile, err := copyFile(src, r.Config.Destination, fmt.Sprintf(".%s.*"+stagedSuffix, file))
+	if err != nil {
+		return err
+	}
+	if err := writeHold(r.Config, hold); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	r.Repodata.hold = hold
+	diff := r.Repodata.index.diff(ctx, "rollback.diff", idx)
+	r.recordDiff("repodata", &diff)
+	r.Repodata.index = idx
+	r.Repodata.key = key
+	stage(&r.Repodata.staged, &stagedIndex{name: file, path: tmpfile})
+	now := time.Now()
+	for _, added := range diff.Added {
+		delete(r.obsolete, added.Filename())
+		delete(r.obsolete, added.Filename()+".sig")
+	}
+	for _, deleted := range diff.Deleted {
+		r.obsolete[deleted.Filename()] = now
+		r.obsolete[deleted.Filename()+".sig"] = now
+	}
+	r.saveObsolete()
+	r.log.Warn("rolling back repodata", "snapshot", date)
+	changed := r.emitChanges(&diff)
+	staged := []*stagedIndex{r.Repodata.staged}
+	r.Repodata.staged = nil
+	prev := r.published
+	r.published = make(chan struct{})
+	go r.waitSync(prev, r.published, nil, staged, changed)
+	return nil
+}
+
+// lookup returns the package of the index whose file or signature is
+// named file.
+func (idx index) lookup(file string) *pkg {
+	base := strings.TrimSuffix(strings.TrimSuffix(file, ".sig"), ".xbps")
+	// strip the architecture and the version
+	if i := strings.LastIndexByte(base, '.'); i > 0 {
+		base = base[:i]
+	}
+	if i := strings.LastIndexByte(base, '-'); i > 0 {
+		if pkg := idx[base[:i]]; pkg != nil && (pkg.Filename() == file || pkg.Filename()+".sig" == file) {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// snapshotHandler serves the snapshots at /snapshots/<date>/<path>/<file>,
+// where path is the path of the upstream of the repository. Snapshots are
+// listed as JSON at /snapshots/.
+type snapshotHandler struct {
+	repos []*Repository
+}
+
+func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := cleanPath(strings.TrimPrefix(req.URL.Path, "/snapshots"))
+	if p == "" {
+		list := make(map[string][]string)
+		for _, r := range h.repos {
+			if r.Config.Snapshots > 0 {
+				list[r.Config.Name] = r.snapshots.dates()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	date, rest, _ := strings.Cut(p, "/")
+	dir, file := path.Split(rest)
+	for _, r := range h.repos {
+		if cleanPath(r.Config.Upstream.Path) != cleanPath(dir) {
+			continue
+		}
+		idx := r.snapshots.index(date)
+		if idx == nil {
+			continue
+		}
+		if file == fmt.Sprintf("%s-repodata", r.Config.Architecture) {
+			http.ServeFile(w, req, r.snapshotPath(date))
+			return
+		}
+		if idx.lookup(file) == nil {
+			continue
+		}
+		f, err := r.storage.Open(req.Context(), file)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			r.log.Error("could not open snapshot file", "name", file, "error", err)
+			http.Error(w, "could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, req, file, time.Time{}, f)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// rollbackHandler rolls the repository named by the "repository" query
+// parameter back to the snapshot named by the "snapshot" parameter.
+type rollbackHandler struct {
+	repos []*Repository
+}
+
+func (h *rollbackHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, date := req.URL.Query().Get("repository"), req.URL.Query().Get("snapshot")
+	for _, r := range h.repos {
+		if r.Config.Name != name {
+			continue
+		}
+		err := r.Rollback(req.Context(), date)
+		if errors.Is(err, errNoSnapshot) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	http.Error(w, "unknown repository", http.StatusNotFound)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	repo.Config.Snapshots = 3
+	repo.Config.ObsoleteMaxAge = time.Nanosecond
+	day := func(d int) time.Time {
+		return time.Date(2023, 6, d, 12, 0, 0, 0, time.UTC)
+	}
+	syncRepository(t, ctx, repo)
+	if err := repo.snapshot(day(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	foo2 := testPkg(t, upstream, "foo-1.1_1", "foo2")
+	writeRepodata(t, repodata, foo2)
+	syncRepository(t, ctx, repo)
+	if err := repo.snapshot(day(2)); err != nil {
+		t.Fatal(err)
+	}
+	// the package is obsolete but kept for the first snapshot
+	assertStored(t, repo, foo.Filename(), foo2.Filename())
+	if dates := repo.snapshots.dates(); len(dates) != 3 || dates[0] != "2023-06-01" || dates[1] != "2023-06-02" {
+		t.Errorf("unexpected snapshots %v", dates)
+	}
+
+	h := &snapshotHandler{repos: []*Repository{repo}}
+	for file, want := range map[string]int{
+		"x86_64-repodata":  http.StatusOK,
+		foo.Filename():     http.StatusOK,
+		foo2.Filename():    http.StatusNotFound,
+		"x86_64-stagedata": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/snapshots/2023-06-01"+upstream+"/"+file, nil))
+		if rec.Code != want {
+			t.Errorf("%s: expected status %d, got %d", file, want, rec.Code)
+		}
+	}
+
+	if err := repo.rollback(ctx, "2023-06-01"); err != nil {
+		t.Fatal(err)
+	}
+	<-repo.published
+	if pkg := repo.Repodata.index["foo"]; pkg == nil || pkg.Pkgver != foo.Pkgver {
+		t.Errorf("expected the index to be rolled back, got %v", pkg)
+	}
+	if _, ok := repo.obsolete[foo2.Filename()]; !ok {
+		t.Errorf("expected %s to be obsolete after the rollback", foo2.Filename())
+	}
+	live, _, err := readRepodata(filepath.Join(repo.Config.Destination, "x86_64-repodata"))
+	if err != nil || live["foo"].Pkgver != foo.Pkgver {
+		t.Errorf("expected the rolled back repodata to be published: %v", err)
+	}
+
+	// the rolled back upstream repodata is ignored until it changes
+	syncRepository(t, ctx, repo)
+	if repo.Repodata.index["foo"].Pkgver != foo.Pkgver {
+		t.Errorf("expected the rollback to hold")
+	}
+	foo3 := testPkg(t, upstream, "foo-1.2_1", "foo3")
+	writeRepodata(t, repodata, foo3)
+	syncRepository(t, ctx, repo)
+	if repo.Repodata.index["foo"].Pkgver != foo3.Pkgver {
+		t.Errorf("expected new upstream repodata to be mirrored")
+	}
+	if _, err := os.Stat(holdPath(repo.Config)); !os.IsNotExist(err) {
+		t.Errorf("expected the hold to be removed")
+	}
+
+	if err := repo.snapshot(day(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(repo.snapshotPath("2023-06-01")); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest snapshot to be removed")
+	}
+	if err := repo.rollback(ctx, "2023-06-01"); err != errNoSnapshot {
+		t.Errorf("expected rollback to a removed snapshot to fail, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// storage is where the files of a repository are published.
+type storage interface {
+	// List returns the names of all stored files.
+	List(ctx context.Context) (map[string]struct{}, error)
+	// Put stores the local file at path as name. sum is the sha256 of
+	// the file if it is known. The file at path may be moved instead of
+	// copied.
+	Put(ctx context.Context, name, path string, sum []byte) error
+	// Delete removes the named file, it is not an error if it does not
+	// exist.
+	Delete(ctx context.Context, name string) error
+	// Open opens the named file for reading. The error wraps
+	// fs.ErrNotExist if it does not exist.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+}
+
+// newStorage returns the storage of repo. The S3 client uses the HTTP
+// settings of the host of its endpoint.
+func newStorage(conf *config.Config, repo *config.RepositoryConfig) (storage, error) {
+	if repo.S3 == nil {
+		return &localStorage{dir: repo.Destination}, nil
+	}
+	t, err := newTransport(conf.Host(repo.S3.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return newS3Storage(repo.S3, t)
+}
+
+// localStorage stores files in a local directory.
+type localStorage struct {
+	dir string
+}
+
+func (s *localStorage) List(ctx context.Context) (map[string]struct{}, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]struct{}{}, nil
+		}
+		return nil, err
+	}
+	files := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || tempfilePattern.MatchString(entry.Name()) {
+			continue
+		}
+		files[entry.Name()] = struct{}{}
+	}
+	return files, nil
+}
+
+func (s *localStorage) Put(ctx context.Context, name, path string, sum []byte) error {
+	return os.Rename(path, filepath.Join(s.dir, name))
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	return os.Open(filepath.Join(s.dir, name))
+}
+
+// s3Storage stores files as objects in an S3 compatible bucket.
+type s3Storage struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+func newS3Storage(conf *config.S3Config, transport http.RoundTripper) (*s3Storage, error) {
+	creds := credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, "")
+	if conf.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		})
+	}
+	client, err := minio.New(conf.Endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    !conf.Insecure,
+		Region:    conf.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		client:   client,
+		bucket:   conf.Bucket,
+		prefix:   conf.Prefix,
+		partSize: conf.PartSize,
+	}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// contentType returns the content type objects are stored with.
+func contentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (s *s3Storage) List(ctx context.Context) (map[string]struct{}, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	files := make(map[string]struct{})
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		// common prefixes of "subdirectories" end with a slash
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		files[strings.TrimPrefix(obj.Key, prefix)] = struct{}{}
+	}
+	return files, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name, path string, sum []byte) error {
+	opts := minio.PutObjectOptions{
+		ContentType: contentType(name),
+		PartSize:    s.partSize,
+	}
+	if sum != nil {
+		opts.UserMetadata = map[string]string{"sha256": hex.EncodeToString(sum)}
+	}
+	_, err := s.client.FPutObject(ctx, s.bucket, s.key(name), path, opts)
+	return err
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// the object is only requested once it is used
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	return obj, nil
+}
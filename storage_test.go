@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// testS3 starts an in-memory S3 server with the bucket "mirror" and
+// returns its configuration and a storage using it. The server uses TLS
+// because it does not understand the chunked uploads of plain HTTP.
+func testS3(t *testing.T) (*config.S3Config, *s3Storage) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("mirror"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(gofakes3.New(backend).Server())
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.S3Config{
+		Endpoint:  u.Host,
+		Bucket:    "mirror",
+		Prefix:    "current",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  5 << 20,
+	}
+	s, err := newS3Storage(conf, srv.Client().Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf, s
+}
+
+func writeTemp(t *testing.T, content []byte) string {
+	f, err := os.CreateTemp(t.TempDir(), "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestS3Storage(t *testing.T) {
+	ctx := context.Background()
+	_, s := testS3(t)
+
+	small := []byte("package")
+	sum := sha256.Sum256(small)
+	if err := s.Put(ctx, "foo-1.0_1.x86_64.xbps", writeTemp(t, small), sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	// larger than a part to upload it in multiple parts
+	large := bytes.Repeat([]byte("x"), 11<<20)
+	if err := s.Put(ctx, "bar-1.0_1.x86_64.xbps", writeTemp(t, large), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.client.StatObject(ctx, "mirror", "current/foo-1.0_1.x86_64.xbps", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "application/octet-stream" || info.UserMetadata["Sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected object metadata: %q %v", info.ContentType, info.UserMetadata)
+	}
+	info, err = s.client.StatObject(ctx, "mirror", "current/bar-1.0_1.x86_64.xbps", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(large)) {
+		t.Errorf("expected %d bytes, got %d", len(large), info.Size)
+	}
+
+	files, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expected 2 files, got %v", files)
+	}
+	if err := s.Delete(ctx, "bar-1.0_1.x86_64.xbps"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := s.List(ctx); err != nil || len(files) != 1 {
+		t.Errorf("expected 1 file after delete, got %v: %v", files, err)
+	}
+}
+
+func TestS3Repository(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+
+	s3conf, s := testS3(t)
+	u := &url.URL{Scheme: "file", Path: upstream}
+	conf := &config.RepositoryConfig{
+		Name:          "test/x86_64",
+		Upstream:      u,
+		Destination:   t.TempDir(),
+		Architecture:  "x86_64",
+		Priority:      1,
+		SeedThreshold: config.DefaultSeedThreshold,
+		S3:            s3conf,
+	}
+	h, err := newHost(&config.HostConfig{Name: "file", Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.sched.Stop)
+	repo, err := NewRepository(ctx, conf, h, newUpstream(u, h), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncRepository(t, ctx, repo)
+
+	files, err := repo.storage.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{foo.Filename(), "x86_64-repodata"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in the bucket, got %v", name, files)
+		}
+	}
+	// only the index is kept locally
+	if _, err := os.Stat(filepath.Join(conf.Destination, foo.Filename())); !os.IsNotExist(err) {
+		t.Errorf("expected no local copy of %s", foo.Filename())
+	}
+	assertStored(t, repo, "x86_64-repodata")
+}
+
+// recordingStorage records the order files are stored in.
+type recordingStorage struct {
+	storage
+	mu  sync.Mutex
+	put []string
+}
+
+func (s *recordingStorage) Put(ctx context.Context, name, path string, sum []byte) error {
+	s.mu.Lock()
+	s.put = append(s.put, name)
+	s.mu.Unlock()
+	return s.storage.Put(ctx, name, path, sum)
+}
+
+func TestPublishOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+	writeRepodata(t, filepath.Join(upstream, "x86_64-stagedata"), foo, bar)
+
+	repo := testFileRepository(t, ctx, upstream)
+	s := &recordingStorage{storage: repo.storage}
+	repo.storage = s
+	syncRepository(t, ctx, repo)
+
+	if len(s.put) != 4 {
+		t.Fatalf("expected 4 stored files, got %v", s.put)
+	}
+	if s.put[2] != "x86_64-stagedata" || s.put[3] != "x86_64-repodata" {
+		t.Errorf("expected the stagedata and then the repodata to be stored last, got %v", s.put)
+	}
+}
+
+func TestRemoveStaged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"))
+	repo := testFileRepository(t, ctx, upstream)
+	dest := repo.Config.Destination
+	stale := filepath.Join(dest, ".x86_64-repodata.1"+stagedSuffix)
+	if err := os.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// another architecture starting in the same destination keeps the
+	// staged files of the running repository
+	other := *repo.Config
+	other.Architecture = "i686"
+	if _, err := NewRepository(ctx, &other, repo.host, repo.upstream, repo.storage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("expected the staged file to be kept: %v", err)
+	}
+	if err := removeStaged([]*config.RepositoryConfig{repo.Config, &other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the staged file to be removed: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// tempfilePattern matches the names os.CreateTemp generates for the
+// ".<name>.*" patterns used by reqextra.ToTemp and reqextra.ToFileAtomic.
+var tempfilePattern = regexp.MustCompile(`^\..+\.[0-9]+$`)
+
+// sweeper removes temporary files that were orphaned by failed or
+// interrupted downloads from the repository destinations.
+type sweeper struct {
+	dirs     []string
+	maxAge   time.Duration
+	interval time.Duration
+	// quarantineMaxAge is how long quarantined downloads are kept
+	quarantineMaxAge time.Duration
+}
+
+func newSweeper(conf *config.Config) *sweeper {
+	s := &sweeper{
+		maxAge:           conf.TempMaxAge,
+		interval:         conf.SweepInterval,
+		quarantineMaxAge: conf.QuarantineMaxAge,
+	}
+	seen := make(map[string]struct{})
+	for _, repo := range conf.Repositories {
+		dir := filepath.Clean(repo.Destination)
+		if _, ok := seen[dir]; ok {
+			continue
+		}
+		seen[dir] = struct{}{}
+		s.dirs = append(s.dirs, dir)
+	}
+	return s
+}
+
+func (s *sweeper) sweepDir(dir string, now time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !tempfilePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		age := now.Sub(info.ModTime())
+		if age < s.maxAge {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				slog.Error("could not delete stale temp file", "path", path, "error", err)
+			}
+			continue
+		}
+		slog.Info("deleted stale temp file", "path", path, "age", age)
+		tempfiles_removed_total.Inc()
+		tempfiles_removed_bytes_total.Add(float64(info.Size()))
+	}
+	return nil
+}
+
+func (s *sweeper) sweep() {
+	now := time.Now()
+	for _, dir := range s.dirs {
+		if err := s.sweepDir(dir, now); err != nil {
+			slog.Error("sweeping temp files failed", "path", dir, "error", err)
+		}
+		if err := sweepQuarantine(dir, s.quarantineMaxAge, now); err != nil {
+			slog.Error("sweeping quarantine failed", "path", dir, "error", err)
+		}
+	}
+}
+
+func (s *sweeper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
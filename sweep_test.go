@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepDir(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	files := map[string]bool{
+		".x86_64-repodata.123456":       true,
+		".foo-1.0_1.x86_64.xbps.987654": true,
+		".foo-1.0_1.x86_64.xbps.sig.42": true,
+		"foo-1.0_1.x86_64.xbps":         false,
+		"x86_64-repodata":               false,
+		".x86_64-repodata.notatempfile": false,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh := filepath.Join(dir, ".bar-1.0_1.noarch.xbps.1")
+	if err := os.WriteFile(fresh, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sweeper{maxAge: time.Hour}
+	if err := s.sweepDir(dir, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed && !os.IsNotExist(err) {
+			t.Errorf("%s: expected to be removed", name)
+		} else if !removed && err != nil {
+			t.Errorf("%s: expected to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temp file was removed: %v", err)
+	}
+}
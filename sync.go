@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// Sync updates the repository once and waits until the downloads of the
+// update finished and its indexes are published. It then deletes the
+// obsolete files and verifies that every package of the indexes is
+// stored. One-shot syncs use it instead of Run.
+func (r *Repository) Sync(ctx context.Context) error {
+	if err := r.runUpdate(ctx); err != nil {
+		return err
+	}
+	r.host.sched.Drain(r.Config.Name)
+	var err error
+	if r.published != nil {
+		select {
+		case <-r.published:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err = r.synced
+	}
+	if r.Config.ObsoleteMaxAge > 0 {
+		r.gc(ctx, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	return r.verifyStored(ctx)
+}
+
+// verifyStored checks that the packages of the indexes are stored, and
+// their signatures if signatures are required.
+func (r *Repository) verifyStored(ctx context.Context) error {
+	files, err := r.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, idx := range []index{r.Stagedata.index, r.Repodata.index} {
+		for _, pkg := range idx {
+			names := []string{pkg.Filename()}
+			if r.Config.RequireSignatures {
+				names = append(names, pkg.Filename()+".sig")
+			}
+			for _, name := range names {
+				if _, ok := files[name]; !ok {
+					r.log.Error("file missing from the destination", "name", name)
+					missing++
+				}
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d files missing from the destination", missing)
+	}
+	return nil
+}
+
+// runSync implements the sync command, it syncs the repositories once
+// and returns the exit status.
+func runSync(conf *config.Config, args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	name := flags.String("repo", "", "only sync the named repository")
+	flags.Parse(args)
+	repoconfs, err := selectRepositories(conf, *name)
+	if err != nil {
+		slog.Error("invalid repository", "error", err)
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer func() {
+		for _, host := range hosts {
+			host.sched.Stop()
+		}
+	}()
+	newSweeper(conf).sweep()
+	if err := removeStaged(repoconfs); err != nil {
+		slog.Error("removing staged files failed", "error", err)
+		return 1
+	}
+
+	var mu sync.Mutex
+	status := 0
+	fail := func() {
+		mu.Lock()
+		status = 1
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for _, repoconf := range repoconfs {
+		host, err := getHost(conf, upstreamHost(repoconf.Upstream))
+		if err != nil {
+			slog.Error("initializing host failed", "error", err)
+			return 1
+		}
+		store, err := newStorage(conf, repoconf)
+		if err != nil {
+			slog.Error("initializing storage failed", "error", err)
+			return 1
+		}
+		repo, err := NewRepository(ctx, repoconf, host, newUpstream(repoconf.Upstream, host), store)
+		if err != nil {
+			slog.Error("initializing repository failed", "repository", repoconf.Name, "error", err)
+			fail()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if err := repo.Sync(ctx); err != nil {
+				repo.log.Error("sync failed", "error", err)
+				fail()
+				return
+			}
+			repo.log.Info("sync finished", "duration", time.Since(start))
+		}()
+	}
+	wg.Wait()
+	for _, h := range hooks {
+		h.flush(ctx)
+	}
+	return status
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	signed := func(pkgver, content string) *pkg {
+		p := testPkg(t, upstream, pkgver, content)
+		if err := os.WriteFile(filepath.Join(upstream, p.Filename()+".sig"), []byte("sig"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	foo := signed("foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	repo.Config.ObsoleteMaxAge = time.Hour
+	if err := repo.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertStored(t, repo, foo.Filename(), foo.Filename()+".sig", "x86_64-repodata")
+
+	foo2 := signed("foo-1.1_1", "foo2")
+	writeRepodata(t, repodata, foo2)
+	if err := repo.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a later sync deletes the obsolete package once it is old enough
+	obsolete, err := readObsolete(repo.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obsolete[foo.Filename()]; !ok {
+		t.Fatalf("expected %s to be recorded as obsolete, got %v", foo.Filename(), obsolete)
+	}
+	for name := range obsolete {
+		obsolete[name] = time.Now().Add(-2 * time.Hour)
+	}
+	if err := writeObsolete(repo.Config, obsolete); err != nil {
+		t.Fatal(err)
+	}
+	// as if the next sync ran in a new process
+	repo, err = NewRepository(ctx, repo.Config, repo.host, repo.upstream, repo.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Config.Destination, foo.Filename())); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted", foo.Filename())
+	}
+	assertStored(t, repo, foo2.Filename())
+
+	// packages that can not be downloaded fail the sync
+	bar := signed("bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo2, bar)
+	if err := os.Remove(filepath.Join(upstream, bar.Filename())); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Sync(ctx); err == nil {
+		t.Error("expected the sync to fail")
+	}
+	if err := repo.verifyStored(ctx); err == nil {
+		t.Error("expected the missing package to be detected")
+	}
+}
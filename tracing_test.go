@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+func TestSetupTracing(t *testing.T) {
+	type export struct {
+		path, auth string
+		body       []byte
+	}
+	exports := make(chan export, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case exports <- export{r.URL.Path, r.Header.Get("Authorization"), body}:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+	ctx := context.Background()
+	shutdown, err := setupTracing(ctx, &config.TracingConfig{
+		Endpoint:    strings.TrimPrefix(collector.URL, "http://"),
+		URLPath:     "/otlp/v1/traces",
+		Insecure:    true,
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+		ServiceName: "void-mirror-test",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(ctx, "update")
+	endSpan(span, errors.New("failed"))
+	// shutting down flushes the span
+	if err := shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-exports:
+		if e.path != "/otlp/v1/traces" || e.auth != "Bearer secret" {
+			t.Errorf("unexpected export to %s with %q", e.path, e.auth)
+		}
+		// the protobuf payload carries the names as plain strings
+		for _, s := range []string{"update", "void-mirror-test", "failed"} {
+			if !strings.Contains(string(e.body), s) {
+				t.Errorf("expected %q in the exported spans", s)
+			}
+		}
+	default:
+		t.Fatal("expected the span to be exported")
+	}
+}
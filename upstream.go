@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/void-linux/void-mirror/reqextra"
+)
+
+// upstream is the source a repository is mirrored from.
+type upstream interface {
+	// Request returns a request for the named file of the repository.
+	Request(name string) *requests.Builder
+	// Fetch performs a request returned by Request.
+	Fetch(ctx context.Context, rb *requests.Builder) error
+}
+
+// httpUpstream fetches files over HTTP with the client, timeouts and
+// retries of its host.
+type httpUpstream struct {
+	url  *url.URL
+	host *host
+}
+
+func (u *httpUpstream) Request(name string) *requests.Builder {
+	return requests.URL(u.url.JoinPath(name).String()).
+		Transport(u.host.transport)
+}
+
+func (u *httpUpstream) Fetch(ctx context.Context, rb *requests.Builder) error {
+	return u.host.fetch(ctx, rb)
+}
+
+// fileTransport serves file:// URLs from the local filesystem. It answers
+// conditional requests and missing files like an HTTP server would.
+var fileTransport = reqextra.TraceTransport(
+	requests.LogTransport(http.NewFileTransport(http.Dir("/")), requestLogger),
+	tracer,
+)
+
+// fileUpstream reads files from a repository on a local or network
+// filesystem.
+type fileUpstream struct {
+	url *url.URL
+}
+
+func (u *fileUpstream) Request(name string) *requests.Builder {
+	return requests.URL(u.url.JoinPath(name).String()).
+		Transport(fileTransport)
+}
+
+func (u *fileUpstream) Fetch(ctx context.Context, rb *requests.Builder) error {
+	return rb.Fetch(ctx)
+}
+
+// upstreamHost returns the name of the host whose download queue is used
+// for the upstream u. All file:// upstreams share the host "file".
+func upstreamHost(u *url.URL) string {
+	if u.Scheme == "file" {
+		return "file"
+	}
+	return u.Host
+}
+
+func newUpstream(u *url.URL, host *host) upstream {
+	if u.Scheme == "file" {
+		return &fileUpstream{url: u}
+	}
+	return &httpUpstream{url: u, host: host}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// testPkg writes a package with the given content to dir and returns its
+// index entry.
+func testPkg(t *testing.T, dir, pkgver, content string) *pkg {
+	sum := sha256.Sum256([]byte(content))
+	p := &pkg{Pkgver: pkgver, Arch: "x86_64", SHA256: sum[:], Size: int64(len(content))}
+	if err := os.WriteFile(filepath.Join(dir, p.Filename()), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// indexPlist returns the index.plist of pkgs.
+func indexPlist(pkgs ...*pkg) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<plist version="1.0"><dict>`)
+	for _, p := range pkgs {
+		name := p.Pkgver[:strings.LastIndex(p.Pkgver, "-")]
+		fmt.Fprintf(&b, "<key>%s</key><dict>", name)
+		fmt.Fprintf(&b, "<key>architecture</key><string>%s</string>", p.Arch)
+		fmt.Fprintf(&b, "<key>filename-sha256</key><string>%s</string>", hex.EncodeToString(p.SHA256))
+		fmt.Fprintf(&b, "<key>filename-size</key><integer>%d</integer>", p.Size)
+		fmt.Fprintf(&b, "<key>pkgver</key><string>%s</string>", p.Pkgver)
+		b.WriteString("</dict>")
+	}
+	b.WriteString("</dict></plist>\n")
+	return b.String()
+}
+
+// writeArchive writes an uncompressed tar archive of files, alternating
+// names and contents, to path.
+func writeArchive(t *testing.T, path string, files ...string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for i := 0; i < len(files); i += 2 {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: files[i],
+			Mode: 0644,
+			Size: int64(len(files[i+1])),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeRepodata writes an uncompressed repodata archive with an index of
+// pkgs to path.
+func writeRepodata(t *testing.T, path string, pkgs ...*pkg) {
+	writeArchive(t, path, "index.plist", indexPlist(pkgs...))
+}
+
+// syncRepository updates repo and waits until the downloads finished and
+// the indexes are published.
+func syncRepository(t *testing.T, ctx context.Context, repo *Repository) {
+	if err := repo.update(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if repo.published == nil {
+		return
+	}
+	select {
+	case <-repo.published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("indexes were not published")
+	}
+}
+
+func assertStored(t *testing.T, repo *Repository, names ...string) {
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(repo.Config.Destination, name)); err != nil {
+			t.Errorf("expected %s in destination: %v", name, err)
+		}
+	}
+}
+
+// testFileRepository returns a repository that mirrors upstream with a
+// file:// upstream into a temporary destination.
+func testFileRepository(t *testing.T, ctx context.Context, upstream string) *Repository {
+	u := &url.URL{Scheme: "file", Path: upstream}
+	conf := &config.RepositoryConfig{
+		Name:          "test/x86_64",
+		Upstream:      u,
+		Destination:   t.TempDir(),
+		Architecture:  "x86_64",
+		Priority:      1,
+		SeedThreshold: config.DefaultSeedThreshold,
+	}
+	h, err := newHost(&config.HostConfig{Name: "file", Jobs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.sched.Stop)
+	repo, err := NewRepository(ctx, conf, h, newUpstream(u, h), &localStorage{dir: conf.Destination})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestFileUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	bar := testPkg(t, upstream, "bar-2.0_1", "bar")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo, bar)
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	assertStored(t, repo, foo.Filename(), bar.Filename(), "x86_64-repodata")
+	if len(repo.Repodata.index) != 2 {
+		t.Errorf("expected 2 packages in the index, got %d", len(repo.Repodata.index))
+	}
+
+	// missing stagedata and an unchanged repodata are no changes
+	syncRepository(t, ctx, repo)
+	if len(repo.pending) != 0 {
+		t.Errorf("expected no downloads, got %d", len(repo.pending))
+	}
+
+	foo2 := testPkg(t, upstream, "foo-1.1_1", "foo2")
+	writeRepodata(t, filepath.Join(upstream, "x86_64-repodata"), foo2, bar)
+	syncRepository(t, ctx, repo)
+	assertStored(t, repo, foo2.Filename())
+	if _, ok := repo.obsolete[foo.Filename()]; !ok {
+		t.Errorf("expected %s to be obsolete", foo.Filename())
+	}
+}
+
+func TestIndexDiff(t *testing.T) {
+	p := func(pkgver, sum string) *pkg {
+		return &pkg{Pkgver: pkgver, Arch: "x86_64", SHA256: digest(sum)}
+	}
+	old := index{
+		"foo":  p("foo-1.0_1", "a"),
+		"bar":  p("bar-2.0_1", "b"),
+		"baz":  p("baz-1.9_1", "c"),
+		"qux":  p("qux-1.0_1", "d"),
+		"gone": p("gone-1.0_1", "e"),
+	}
+	d := old.Diff(index{
+		"foo": p("foo-1.10_1", "f"),
+		"bar": p("bar-2.0rc1_1", "g"),
+		"baz": p("baz-1.9_1", "h"),
+		"qux": p("qux-1.0_1", "d"),
+		"new": p("new-1.0_1", "i"),
+	})
+	if len(d.Upgraded) != 1 || d.Upgraded[0].New.Pkgver != "foo-1.10_1" {
+		t.Errorf("expected foo to be upgraded, got %+v", d.Upgraded)
+	}
+	if len(d.Downgraded) != 1 || d.Downgraded[0].Old.Pkgver != "bar-2.0_1" {
+		t.Errorf("expected bar to be downgraded, got %+v", d.Downgraded)
+	}
+	if len(d.Rebuilt) != 1 || d.Rebuilt[0].New.Pkgver != "baz-1.9_1" {
+		t.Errorf("expected baz to be rebuilt, got %+v", d.Rebuilt)
+	}
+	if len(d.Added) != 3 || len(d.Deleted) != 3 {
+		t.Errorf("expected 3 added and 3 deleted packages, got %d and %d", len(d.Added), len(d.Deleted))
+	}
+}
+
+func TestDowngradeHold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.1_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	repo.Config.Downgrades = config.DowngradeHold
+	syncRepository(t, ctx, repo)
+	old := testPkg(t, upstream, "foo-1.0_1", "old")
+	writeRepodata(t, repodata, old)
+	syncRepository(t, ctx, repo)
+	syncRepository(t, ctx, repo)
+	if pkg := repo.Repodata.index["foo"]; pkg.Pkgver != foo.Pkgver {
+		t.Errorf("expected the downgrade to be held, got %s", pkg.Pkgver)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Config.Destination, old.Filename())); !os.IsNotExist(err) {
+		t.Errorf("expected the downgraded package not to be fetched")
+	}
+
+	// the next repodata without downgrades is mirrored
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+	syncRepository(t, ctx, repo)
+	assertStored(t, repo, bar.Filename())
+
+	repo.Config.Downgrades = config.DowngradeWarn
+	writeRepodata(t, repodata, old, bar)
+	syncRepository(t, ctx, repo)
+	if pkg := repo.Repodata.index["foo"]; pkg.Pkgver != old.Pkgver {
+		t.Errorf("expected the downgrade to be mirrored, got %s", pkg.Pkgver)
+	}
+	assertStored(t, repo, old.Filename())
+}
+
+func TestRebuiltPackage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	rebuilt := testSignedPkg(t, upstream, "foo-1.0_1", "rebuilt foo")
+	writeRepodata(t, repodata, rebuilt)
+
+	// hold back the publication until the download is staged
+	prev := make(chan struct{})
+	repo.published = prev
+	if err := repo.update(ctx); err != nil {
+		t.Fatal(err)
+	}
+	published := repo.published
+	pattern := filepath.Join(repo.Config.Destination, "."+foo.Filename()+".*"+stagedSuffix)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		// the package and its signature
+		if matches, _ := filepath.Glob(pattern); len(matches) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rebuilt package was not staged")
+		}
+	}
+	path := filepath.Join(repo.Config.Destination, foo.Filename())
+	if data, _ := os.ReadFile(path); string(data) != "foo" {
+		t.Errorf("expected the old package until the index is published, got %q", data)
+	}
+	close(prev)
+	<-published
+	if data, _ := os.ReadFile(path); string(data) != "rebuilt foo" {
+		t.Errorf("expected the rebuilt package, got %q", data)
+	}
+	if matches, _ := filepath.Glob(pattern); len(matches) != 0 {
+		t.Errorf("expected no staged files, got %v", matches)
+	}
+}
+
+// testSignedPkg is testPkg with an unverified signature.
+func testSignedPkg(t *testing.T, dir, pkgver, content string) *pkg {
+	p := testPkg(t, dir, pkgver, content)
+	if err := os.WriteFile(filepath.Join(dir, p.Filename()+".sig"), []byte("sig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRebuiltPackageFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	stored, err := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := testSignedPkg(t, upstream, "foo-1.0_1", "rebuilt foo")
+	writeRepodata(t, repodata, rebuilt)
+	// the download of the rebuilt package fails
+	if err := os.Remove(filepath.Join(upstream, rebuilt.Filename())); err != nil {
+		t.Fatal(err)
+	}
+	syncRepository(t, ctx, repo)
+	if repo.synced == nil {
+		t.Error("expected an error for the failed download")
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata")); !bytes.Equal(data, stored) {
+		t.Error("expected the index not to be published")
+	}
+
+	// the next update downloads the package again
+	testPkg(t, upstream, "foo-1.0_1", "rebuilt foo")
+	syncRepository(t, ctx, repo)
+	if repo.synced != nil {
+		t.Errorf("unexpected error %v", repo.synced)
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo.Config.Destination, foo.Filename())); string(data) != "rebuilt foo" {
+		t.Errorf("expected the rebuilt package, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata")); bytes.Equal(data, stored) {
+		t.Error("expected the index to be published")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(repo.Config.Destination, ".*"+stagedSuffix)); len(matches) != 0 {
+		t.Errorf("expected no staged files, got %v", matches)
+	}
+}
+
+func TestPackageFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+	stored, err := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+	// the download of the new package fails
+	if err := os.Remove(filepath.Join(upstream, bar.Filename())); err != nil {
+		t.Fatal(err)
+	}
+	syncRepository(t, ctx, repo)
+	if repo.synced == nil {
+		t.Error("expected an error for the failed download")
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata")); !bytes.Equal(data, stored) {
+		t.Error("expected the index not to be published")
+	}
+
+	// the next update downloads the package again
+	testPkg(t, upstream, "bar-1.0_1", "bar")
+	syncRepository(t, ctx, repo)
+	if repo.synced != nil {
+		t.Errorf("unexpected error %v", repo.synced)
+	}
+	assertStored(t, repo, bar.Filename())
+	if data, _ := os.ReadFile(filepath.Join(repo.Config.Destination, "x86_64-repodata")); bytes.Equal(data, stored) {
+		t.Error("expected the index to be published")
+	}
+}
+
+func TestStagedataFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream := t.TempDir()
+	repodata := filepath.Join(upstream, "x86_64-repodata")
+	stagedata := filepath.Join(upstream, "x86_64-stagedata")
+	foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+	writeRepodata(t, repodata, foo)
+	repo := testFileRepository(t, ctx, upstream)
+	syncRepository(t, ctx, repo)
+
+	bar := testPkg(t, upstream, "bar-1.0_1", "bar")
+	writeRepodata(t, repodata, foo, bar)
+	if err := os.WriteFile(stagedata, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.update(ctx); err == nil {
+		t.Fatal("expected the broken stagedata to fail the update")
+	}
+	// the new repodata is discarded
+	if _, ok := repo.Repodata.index["bar"]; ok || repo.Repodata.staged != nil {
+		t.Error("expected the new repodata to be discarded")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(repo.Config.Destination, ".*"+stagedSuffix)); len(matches) != 0 {
+		t.Errorf("expected no staged files, got %v", matches)
+	}
+
+	// and fetched again by the next update
+	if err := os.Remove(stagedata); err != nil {
+		t.Fatal(err)
+	}
+	syncRepository(t, ctx, repo)
+	assertStored(t, repo, bar.Filename())
+	if idx, _, err := readRepodata(filepath.Join(repo.Config.Destination, "x86_64-repodata")); err != nil || len(idx) != 2 {
+		t.Errorf("expected the new repodata to be published, got %v %v", idx, err)
+	}
+}
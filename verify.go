@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/carlmjohnson/requests"
+
+	"github.com/Duncaen/go-xbps/crypto"
+	"github.com/Duncaen/go-xbps/repo"
+	"github.com/Duncaen/go-xbps/util"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+var (
+	errUnsigned     = errors.New("index is not signed")
+	errUntrustedKey = errors.New("index names an untrusted key")
+	errBadSignature = errors.New("invalid index signature")
+)
+
+// readKey reads a public key from an xbps key file, as found in
+// /var/db/xbps/keys, or a PEM encoded public key.
+func readKey(path string) (*repo.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported public key type", path)
+		}
+		return &repo.PublicKey{Key: key}, nil
+	}
+	var key repo.PublicKey
+	if err := repo.ParsePublicKey(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &key, nil
+}
+
+// verifier pins the key indexes name to the trusted keys and, with
+// signature set, verifies their detached signatures with it.
+type verifier struct {
+	// keys are the trusted keys by fingerprint
+	keys      map[string]*repo.PublicKey
+	signature bool
+	upstream  upstream
+}
+
+// newVerifier loads the trusted keys of conf. It returns nil if the
+// repository has no trusted keys.
+func newVerifier(conf *config.RepositoryConfig, upstream upstream) (*verifier, error) {
+	if len(conf.TrustedKeys) == 0 {
+		return nil, nil
+	}
+	v := &verifier{
+		keys:      make(map[string]*repo.PublicKey),
+		signature: conf.IndexSignature,
+		upstream:  upstream,
+	}
+	for _, pattern := range conf.TrustedKeys {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no trusted keys found at %s", pattern)
+		}
+		for _, path := range paths {
+			key, err := readKey(path)
+			if err != nil {
+				return nil, err
+			}
+			v.keys[key.Fingerprint()] = key
+		}
+	}
+	return v, nil
+}
+
+// verify checks that key, the public key of the index-meta.plist of the
+// index file fetched to path, is trusted. The key is only compared by
+// fingerprint, anyone can copy it into an index, so the index is only
+// authenticated if its detached signature is verified as well.
+func (v *verifier) verify(ctx context.Context, file, path string, key *repo.PublicKey) error {
+	if v == nil {
+		return nil
+	}
+	if key == nil || key.Key == nil {
+		return errUnsigned
+	}
+	trusted, ok := v.keys[key.Fingerprint()]
+	if !ok {
+		return fmt.Errorf("%w: %s (%s)", errUntrustedKey, key.Fingerprint(), key.SignedBy)
+	}
+	if !v.signature {
+		return nil
+	}
+	var sig bytes.Buffer
+	err := v.upstream.Fetch(ctx, v.upstream.Request(file+".sig").
+		Handle(requests.ToBytesBuffer(&sig)))
+	if err != nil {
+		return fmt.Errorf("fetching index signature: %w", err)
+	}
+	sum, err := util.FileSha256(path)
+	if err != nil {
+		return err
+	}
+	if err := crypto.Verify(trusted.Key, sum, sig.Bytes()); err != nil {
+		return fmt.Errorf("%w: %v", errBadSignature, err)
+	}
+	return nil
+}
+
+var (
+	errUnsignedPackage     = errors.New("package is not signed")
+	errBadPackageSignature = errors.New("invalid package signature")
+)
+
+// signingKey returns the key the packages of the repository are signed
+// with, the key of the repodata or else of the stagedata. It is nil if
+// neither index is signed.
+func (r *Repository) signingKey() *repo.PublicKey {
+	if r.Repodata.key != nil {
+		return r.Repodata.key
+	}
+	return r.Stagedata.key
+}
+
+// verifySig verifies sig, the signature xbps made over the sha256 of pkg,
+// with key.
+func verifySig(key *repo.PublicKey, pkg *pkg, sig []byte) error {
+	if key == nil {
+		return errUnsigned
+	}
+	if err := crypto.Verify(key.Key, pkg.SHA256, sig); err != nil {
+		return fmt.Errorf("%w: %s: %v", errBadPackageSignature, pkg.Filename(), err)
+	}
+	return nil
+}
+
+// checkSig verifies the signature of pkg at path with key. A signature
+// that does not verify is quarantined.
+func (r *Repository) checkSig(key *repo.PublicKey, pkg *pkg, path string) error {
+	sig, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = verifySig(key, pkg, sig)
+	if errors.Is(err, errBadPackageSignature) {
+		signature_verification_failures_total.WithLabelValues(r.Config.Name).Inc()
+		r.quarantine(path, &quarantined{
+			Name:   pkg.Filename() + ".sig",
+			Reason: quarantineSignature,
+			Error:  err.Error(),
+		})
+	}
+	return err
+}
+
+// fetchSig fetches the signature of pkg from the upstream and verifies it
+// with key.
+func (r *Repository) fetchSig(ctx context.Context, key *repo.PublicKey, pkg *pkg) error {
+	var sig bytes.Buffer
+	err := r.upstream.Fetch(ctx, r.upstream.Request(pkg.Filename()+".sig").
+		Handle(requests.ToBytesBuffer(&sig)))
+	if requests.HasStatusErr(err, http.StatusNotFound) {
+		return fmt.Errorf("%w: %s", errUnsignedPackage, pkg.Filename())
+	} else if err != nil {
+		return err
+	}
+	// a bad signature is counted and quarantined by its own download
+	return verifySig(key, pkg, sig.Bytes())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Duncaen/go-xbps/crypto"
+)
+
+// testKey generates a signing key and writes its public key to a PEM file
+// in a temporary directory.
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, publicKeyPEM(t, priv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return priv, path
+}
+
+func publicKeyPEM(t *testing.T, priv *rsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// writeSignedRepodata writes a repodata archive like writeRepodata, with
+// the public key of priv in its index-meta.plist and a detached signature.
+func writeSignedRepodata(t *testing.T, path string, priv *rsa.PrivateKey, pkgs ...*pkg) {
+	meta := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>public-key</key><data>%s</data>
+<key>public-key-size</key><integer>%d</integer>
+<key>signature-by</key><string>Test &lt;test@example.org&gt;</string>
+</dict></plist>
+`, base64.StdEncoding.EncodeToString(publicKeyPEM(t, priv)), priv.N.BitLen())
+	writeArchive(t, path, "index.plist", indexPlist(pkgs...), "index-meta.plist", meta)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	sig, err := crypto.Sign(priv, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".sig", sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRepodata(t *testing.T) {
+	trusted, keyfile := testKey(t)
+	untrusted, _ := testKey(t)
+
+	tests := []struct {
+		name      string
+		signature bool
+		write     func(t *testing.T, path string, pkgs ...*pkg)
+		err       error
+	}{
+		{
+			name: "trusted",
+			write: func(t *testing.T, path string, pkgs ...*pkg) {
+				writeSignedRepodata(t, path, trusted, pkgs...)
+			},
+		},
+		{
+			name:      "trusted signature",
+			signature: true,
+			write: func(t *testing.T, path string, pkgs ...*pkg) {
+				writeSignedRepodata(t, path, trusted, pkgs...)
+			},
+		},
+		{
+			name: "untrusted",
+			write: func(t *testing.T, path string, pkgs ...*pkg) {
+				writeSignedRepodata(t, path, untrusted, pkgs...)
+			},
+			err: errUntrustedKey,
+		},
+		{
+			name:  "unsigned",
+			write: writeRepodata,
+			err:   errUnsigned,
+		},
+		{
+			name:      "bad signature",
+			signature: true,
+			write: func(t *testing.T, path string, pkgs ...*pkg) {
+				writeSignedRepodata(t, path, trusted, pkgs...)
+				// the index changed after it was signed
+				writeSignedRepodata(t, path+".new", trusted)
+				if err := os.Rename(path+".new.sig", path+".sig"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: errBadSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			upstream := t.TempDir()
+			foo := testPkg(t, upstream, "foo-1.0_1", "foo")
+			tt.write(t, filepath.Join(upstream, "x86_64-repodata"), foo)
+
+			repo := testFileRepository(t, ctx, upstream)
+			repo.Config.TrustedKeys = []string{filepath.Join(filepath.Dir(keyfile), "*.pem")}
+			repo.Config.IndexSignature = tt.signature
+			v, err := newVerifier(repo.Config, repo.upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.Repodata.verifier = v
+
+			_, err = repo.Repodata.Update(ctx)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if tt.err != nil {
+				if repo.Repodata.staged != nil || repo.Repodata.index != nil {
+					t.Error("expected rejected repodata not to be staged")
+				}
+				return
+			}
+			if repo.Repodata.key == nil || repo.Repodata.key.Key.N.Cmp(trusted.N) != 0 {
+				t.Error("expected the repodata key to be the trusted key")
+			}
+			if len(repo.Repodata.index) != 1 {
+				t.Errorf("expected 1 package in the index, got %d", len(repo.Repodata.index))
+			}
+		})
+	}
+}
+
+// writeSig writes the signature of pkg made with priv to dir.
+func writeSig(t *testing.T, dir string, priv *rsa.PrivateKey, pkg *pkg) {
+	sig, err := crypto.Sign(priv, pkg.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, pkg.Filename()+".sig"), sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyPackageSignatures(t *testing.T) {
+	priv, _ := testKey(t)
+	other, _ := testKey(t)
+
+	for _, require := range []bool{false, true} {
+		t.Run(fmt.Sprintf("require=%v", require), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			upstream := t.TempDir()
+			good := testPkg(t, upstream, "good-1.0_1", "good")
+			bad := testPkg(t, upstream, "bad-1.0_1", "bad")
+			unsigned := testPkg(t, upstream, "unsigned-1.0_1", "unsigned")
+			writeSig(t, upstream, priv, good)
+			writeSig(t, upstream, other, bad)
+			writeSignedRepodata(t, filepath.Join(upstream, "x86_64-repodata"), priv, good, bad, unsigned)
+
+			repo := testFileRepository(t, ctx, upstream)
+			repo.Config.RequireSignatures = require
+			syncRepository(t, ctx, repo)
+
+			assertStored(t, repo, good.Filename(), good.Filename()+".sig")
+			quarantined, err := listQuarantine(repo.Config.Destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(quarantined) != 1 || quarantined[0].Name != bad.Filename()+".sig" || quarantined[0].Reason != quarantineSignature {
+				t.Errorf("expected the bad signature to be quarantined, got %+v", quarantined)
+			}
+			if _, err := os.Stat(filepath.Join(repo.Config.Destination, bad.Filename()+".sig")); !os.IsNotExist(err) {
+				t.Errorf("expected the bad signature not to be published")
+			}
+			for _, p := range []*pkg{bad, unsigned} {
+				_, err := os.Stat(filepath.Join(repo.Config.Destination, p.Filename()))
+				if require && !os.IsNotExist(err) {
+					t.Errorf("expected %s to be refused", p.Filename())
+				} else if !require && err != nil {
+					t.Errorf("expected %s to be published: %v", p.Filename(), err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+// maxWebhookBody limits the size of webhook request bodies.
+const maxWebhookBody = 64 << 10
+
+// triggerRequest is the body of a webhook request. All fields that are
+// set must match for a repository to be triggered.
+type triggerRequest struct {
+	Repository   string `json:"repository"`
+	Path         string `json:"path"`
+	Architecture string `json:"architecture"`
+}
+
+func (t *triggerRequest) empty() bool {
+	return t.Repository == "" && t.Path == "" && t.Architecture == ""
+}
+
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func (t *triggerRequest) match(conf *config.RepositoryConfig) bool {
+	if t.Repository != "" && t.Repository != conf.Name {
+		return false
+	}
+	if t.Path != "" && cleanPath(t.Path) != cleanPath(conf.Upstream.Path) {
+		return false
+	}
+	if t.Architecture != "" && t.Architecture != conf.Architecture {
+		return false
+	}
+	return true
+}
+
+// webhook triggers updates of repositories when notified by upstream.
+// Notifications are debounced, a burst of notifications for the same
+// repository results in a single update.
+type webhook struct {
+	conf   *config.WebhookConfig
+	repos  []*Repository
+	mu     sync.Mutex
+	timers map[*Repository]*pendingTrigger
+}
+
+// pendingTrigger is a debounced update of a repository.
+type pendingTrigger struct {
+	timer *time.Timer
+	// first is the time of the first notification
+	first time.Time
+}
+
+func newWebhook(conf *config.WebhookConfig, repos []*Repository) *webhook {
+	return &webhook{
+		conf:   conf,
+		repos:  repos,
+		timers: make(map[*Repository]*pendingTrigger),
+	}
+}
+
+// authorized checks the bearer token or the HMAC-SHA256 signature of body
+// in the X-Signature-256 header, formatted as "sha256=<hex>".
+func (wh *webhook) authorized(r *http.Request, body []byte) bool {
+	return authorized(wh.conf, r, body)
+}
+
+func authorized(conf *config.WebhookConfig, r *http.Request, msg []byte) bool {
+	if conf.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(conf.Token)) == 1 {
+				return true
+			}
+		}
+	}
+	if conf.Secret != "" {
+		if sig, ok := strings.CutPrefix(r.Header.Get("X-Signature-256"), "sha256="); ok {
+			got, err := hex.DecodeString(sig)
+			if err != nil {
+				return false
+			}
+			mac := hmac.New(sha256.New, []byte(conf.Secret))
+			mac.Write(msg)
+			return hmac.Equal(got, mac.Sum(nil))
+		}
+	}
+	return false
+}
+
+// adminHandler serves the admin endpoints to requests that carry the
+// webhook token as bearer token. Signatures are not accepted, a captured
+// signed request could be replayed.
+type adminHandler struct {
+	token string
+	h     http.Handler
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(&config.WebhookConfig{Token: a.token}, r, nil) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.h.ServeHTTP(w, r)
+}
+
+func (wh *webhook) trigger(repo *Repository) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if p, ok := wh.timers[repo]; ok {
+		// wait for the debounce, but no longer than the max wait after
+		// the first notification
+		delay := wh.conf.Debounce
+		if left := wh.conf.MaxWait - time.Since(p.first); left < delay {
+			delay = left
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		p.timer.Reset(delay)
+		return
+	}
+	p := &pendingTrigger{first: time.Now()}
+	p.timer = time.AfterFunc(wh.conf.Debounce, func() {
+		wh.mu.Lock()
+		if wh.timers[repo] == p {
+			delete(wh.timers, repo)
+		}
+		wh.mu.Unlock()
+		repo.Trigger()
+	})
+	wh.timers[repo] = p
+}
+
+func (wh *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !wh.authorized(r, body) {
+		webhook_requests_total.WithLabelValues("unauthorized").Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req triggerRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.empty() {
+		webhook_requests_total.WithLabelValues("invalid").Inc()
+		http.Error(w, "invalid trigger request", http.StatusBadRequest)
+		return
+	}
+	var triggered []string
+	for _, repo := range wh.repos {
+		if req.match(repo.Config) {
+			wh.trigger(repo)
+			triggered = append(triggered, repo.Config.Name)
+		}
+	}
+	if len(triggered) == 0 {
+		webhook_requests_total.WithLabelValues("unmatched").Inc()
+		http.Error(w, "no matching repository", http.StatusNotFound)
+		return
+	}
+	webhook_requests_total.WithLabelValues("triggered").Inc()
+	slog.Info("webhook triggered update", "repositories", triggered)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		Triggered []string `json:"triggered"`
+	}{triggered})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/void-linux/void-mirror/config"
+)
+
+func testRepository(t *testing.T, upstream, arch string) *Repository {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Repository{
+		Config: &config.RepositoryConfig{
+			Name:         cleanPath(u.Path) + "/" + arch,
+			Upstream:     u,
+			Architecture: arch,
+		},
+		Repodata:  &Repodata{},
+		Stagedata: &Stagedata{},
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+func triggered(repo *Repository) bool {
+	select {
+	case <-repo.trigger:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	glibc := testRepository(t, "https://repo-fi.voidlinux.org/current", "x86_64")
+	musl := testRepository(t, "https://repo-fi.voidlinux.org/current/musl", "x86_64-musl")
+	wh := newWebhook(&config.WebhookConfig{
+		Token:  "token",
+		Secret: "secret",
+	}, []*Repository{glibc, musl})
+
+	body := `{"path": "/current/musl/"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		body      string
+		header    string
+		value     string
+		status    int
+		triggered *Repository
+	}{
+		{"no auth", body, "", "", http.StatusUnauthorized, nil},
+		{"bad token", body, "Authorization", "Bearer nope", http.StatusUnauthorized, nil},
+		{"bad signature", body, "X-Signature-256", "sha256=00", http.StatusUnauthorized, nil},
+		{"signature", body, "X-Signature-256", signature, http.StatusAccepted, musl},
+		{"token", `{"architecture": "x86_64"}`, "Authorization", "Bearer token", http.StatusAccepted, glibc},
+		{"unmatched", `{"architecture": "i686"}`, "Authorization", "Bearer token", http.StatusNotFound, nil},
+		{"empty", `{}`, "Authorization", "Bearer token", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/trigger", strings.NewReader(tt.body))
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		for _, repo := range []*Repository{glibc, musl} {
+			if got, want := triggered(repo), repo == tt.triggered; got != want {
+				t.Errorf("%s: %s triggered %v, want %v", tt.name, repo.Config.Name, got, want)
+			}
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	h := &adminHandler{
+		token: "token",
+		h: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	uri := "/rollback?repository=current/x86_64&snapshot=2023-06-01"
+	mac := hmac.New(sha256.New, []byte("token"))
+	mac.Write([]byte(uri))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"no auth", "", "", http.StatusUnauthorized},
+		{"bad token", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"token", "Authorization", "Bearer token", http.StatusNoContent},
+		// signatures could be replayed
+		{"signature", "X-Signature-256", signature, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, uri, nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestWebhookMaxWait(t *testing.T) {
+	repo := testRepository(t, "https://repo-fi.voidlinux.org/current", "x86_64")
+	wh := newWebhook(&config.WebhookConfig{
+		Debounce: 50 * time.Millisecond,
+		MaxWait:  150 * time.Millisecond,
+	}, []*Repository{repo})
+	// notifications arrive faster than the debounce
+	start := time.Now()
+	stop := time.After(time.Second)
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-repo.trigger:
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("update ran after %s", d)
+			}
+			return
+		case <-tick.C:
+			wh.trigger(repo)
+		case <-stop:
+			t.Fatal("expected the update to run within the max wait")
+		}
+	}
+}